@@ -4,6 +4,7 @@ import (
 	"os"
 
 	"github.com/authzed/internal/thumper/internal/cmd"
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
 
 	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
 	"github.com/jzelinskie/cobrautil/v2"
@@ -14,12 +15,10 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var buckets = []float64{.006, .010, .018, .024, .032, .042, .056, .075, .100, .178, .316, .562, 1.000}
-
 func main() {
 	// GCP stackdriver compatible logs
 	zerolog.LevelFieldName = "severity"
-	grpc_prometheus.EnableClientHandlingTimeHistogram(grpc_prometheus.WithHistogramBuckets(buckets))
+	grpc_prometheus.EnableClientHandlingTimeHistogram(grpc_prometheus.WithHistogramBuckets(thumperrunner.LatencyBuckets))
 
 	rootCmd := &cobra.Command{
 		Use:               "thumper",
@@ -55,8 +54,18 @@ func main() {
 	cmd.RegisterRunFlags(cmd.RunCmd)
 	rootCmd.AddCommand(cmd.RunCmd)
 
+	cmd.RegisterMigrateFlags(cmd.MigrateCmd)
 	rootCmd.AddCommand(cmd.MigrateCmd)
 
+	cmd.RegisterCapacityFlags(cmd.CapacityCmd)
+	rootCmd.AddCommand(cmd.CapacityCmd)
+
+	cmd.RegisterCoordinatorFlags(cmd.CoordinatorCmd)
+	rootCmd.AddCommand(cmd.CoordinatorCmd)
+
+	cmd.RegisterAgentFlags(cmd.AgentCmd)
+	rootCmd.AddCommand(cmd.AgentCmd)
+
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
 	}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/distributed"
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/jzelinskie/cobrautil/v2"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func RegisterAgentFlags(cmd *cobra.Command) {
+	hostname, _ := os.Hostname()
+
+	cmd.Flags().String("coordinator", "localhost:50055", "address of the coordinator to join")
+	cmd.Flags().String("name", fmt.Sprintf("%s-%d", hostname, os.Getpid()), "unique name of this agent")
+	cmd.Flags().Float64("weight", 1, "share of the total rate this agent takes on, relative to the other agents")
+	cmd.Flags().Int("workers", 0, "number of workers, each with its own copy of the scripts (0 for one per query per second, up to 100)")
+	cmd.Flags().Int("connections", 4, "number of connections to SpiceDB, shared by all workers")
+	cmd.Flags().Duration("step-timeout", 500*time.Millisecond, "maximum time a single step is allowed to run")
+	cmd.Flags().Bool("randomize-starting-step", false, "randomize the starting script step for each worker")
+
+	cmd.Flags().Duration("drain-timeout", 10*time.Second, "how long steps in flight when a run stops are given to finish before they are cancelled (0 to wait for all of them)")
+
+	// Register http flags
+	registerMetricsFlags(cmd)
+}
+
+var AgentCmd = &cobra.Command{
+	Use:   "agent",
+	Short: "generate load on behalf of a coordinator",
+	Example: `
+	Join a coordinator and run its scripts against a local SpiceDB:
+		thumper agent --coordinator localhost:50055 --token "testtesttesttest"
+
+	Run several agents on one machine:
+		thumper agent --coordinator localhost:50055 --token "testtesttesttest" --metrics-addr :9091
+	`,
+	Args:    cobra.NoArgs,
+	RunE:    agentCmdFunc,
+	PreRunE: DefaultPreRunE("thumper"),
+}
+
+func agentCmdFunc(cmd *cobra.Command, _ []string) error {
+	conn, err := grpc.NewClient(
+		cobrautil.MustGetString(cmd, "coordinator"),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to connect to coordinator: %w", err)
+	}
+	defer conn.Close()
+
+	stopMetricsServer := startMetricsServer(cmd)
+	defer stopMetricsServer()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	return distributed.RunAgent(ctx, conn, distributed.AgentOptions{
+		Name:   cobrautil.MustGetString(cmd, "name"),
+		Weight: cobrautil.MustGetFloat64(cmd, "weight"),
+	}, func(start *distributed.StartCommand, stop <-chan struct{}) (thumperrunner.ResultsSnapshot, error) {
+		return runAgentShare(cmd, start, stop)
+	})
+}
+
+// runAgentShare runs the share of a run assigned to this agent.
+func runAgentShare(cmd *cobra.Command, start *distributed.StartCommand, stop <-chan struct{}) (thumperrunner.ResultsSnapshot, error) {
+	startAt := time.Now().Add(start.StartDelay)
+	results := thumperrunner.NewResults()
+
+	arrival, err := thumperrunner.ParseArrivalMode(start.Arrival)
+	if err != nil {
+		return results.Snapshot(), err
+	}
+
+	numWorkers := numWorkersForRate(cobrautil.MustGetInt(cmd, "workers"), start.QPS)
+	if numWorkers < 1 {
+		return results.Snapshot(), fmt.Errorf("workers must be at least 1, got %d", numWorkers)
+	}
+
+	workerScripts, err := loadWorkerScripts(cmd, start.Scripts, numWorkers, start.Seed)
+	if err != nil {
+		return results.Snapshot(), err
+	}
+
+	clients, err := clientPoolFromFlags(cmd)
+	if err != nil {
+		return results.Snapshot(), err
+	}
+	defer clients.Close()
+
+	workers, err := createWorkers(cmd, workerScripts, clients, results, nil, nil, nil, start.Seed)
+	if err != nil {
+		return results.Snapshot(), err
+	}
+
+	// Wait for the other agents, so that all of them start at the same time.
+	select {
+	case <-time.After(time.Until(startAt)):
+	case <-stop:
+		return results.Snapshot(), nil
+	}
+
+	scheduler := thumperrunner.NewScheduler(thumperrunner.SchedulerOptions{
+		Workers: workers,
+		QPS:     start.QPS,
+		Arrival: arrival,
+		Share:   start.Share,
+		Rand:    thumperrunner.NewRand(thumperrunner.DeriveSeed(start.Seed, "scheduler", 0)),
+		Limits: thumperrunner.RunLimits{
+			Duration:     start.Duration,
+			Requests:     start.Requests,
+			DrainTimeout: cobrautil.MustGetDuration(cmd, "drain-timeout"),
+		},
+	})
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-stop:
+			scheduler.Stop()
+		case <-finished:
+		}
+	}()
+
+	scheduler.Run(context.Background())
+	return results.Snapshot(), nil
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/jzelinskie/cobrautil/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func RegisterCapacityFlags(cmd *cobra.Command) {
+	cmd.Flags().Float64("start-qps", 10, "rate of the first step window")
+	cmd.Flags().Float64("max-qps", 100000, "highest rate that will be tried")
+	cmd.Flags().Float64("growth", 2, "factor by which the rate grows while every step window meets the objective")
+	cmd.Flags().Float64("precision", 0.05, "stop once the highest passing and the lowest failing rate are this close, relative to the passing rate")
+	cmd.Flags().Duration("step-duration", 30*time.Second, "length of each step window")
+	cmd.Flags().Duration("max-p99-latency", 100*time.Millisecond, "highest p99 latency a step window may have to meet the objective")
+	cmd.Flags().Float64("max-error-rate", 0.01, "highest fraction of failed steps a step window may have to meet the objective")
+	cmd.Flags().Int("workers", 10, "number of workers, each with its own copy of the scripts")
+	cmd.Flags().Int("connections", 4, "number of connections to SpiceDB, shared by all workers")
+	cmd.Flags().Duration("step-timeout", 500*time.Millisecond, "maximum time a single step is allowed to run")
+	cmd.Flags().Bool("randomize-starting-step", false, "randomize the starting script step for each worker")
+	cmd.Flags().Int64("seed", 0, "seed for every random choice, which makes runs with the same seed and flags issue the same requests (0 for a new seed, which is logged)")
+	cmd.Flags().String("arrival", string(thumperrunner.ArrivalPoisson), "how requests are spaced over time: fixed, uniform, or poisson")
+	cmd.Flags().Duration("drain-timeout", 10*time.Second, "how long steps in flight at the end of a step window are given to finish before they are cancelled (0 to wait for all of them)")
+
+	// Register http flags
+	registerMetricsFlags(cmd)
+}
+
+var CapacityCmd = &cobra.Command{
+	Use:   "capacity script.yaml [script2.yaml] [script3.yaml]",
+	Short: "find the highest rate that meets a latency and error objective",
+	Example: `
+	Find the highest rate a local SpiceDB sustains with a p99 under 50ms:
+		thumper capacity ./scripts/script.yaml --token "testtesttesttest" --max-p99-latency 50ms
+
+	Use shorter step windows and a finer search:
+		thumper capacity ./scripts/script.yaml --token "testtesttesttest" --step-duration 10s --precision 0.02
+	`,
+	Args:    cobra.MinimumNArgs(1),
+	RunE:    capacityCmdFunc,
+	PreRunE: DefaultPreRunE("thumper"),
+}
+
+// capacityWindow is the outcome of running a single rate during a search.
+type capacityWindow struct {
+	target   float64
+	achieved float64
+	summary  thumperrunner.OpSummary
+	passed   bool
+}
+
+func capacityCmdFunc(cmd *cobra.Command, args []string) error {
+	stepDuration := cobrautil.MustGetDuration(cmd, "step-duration")
+	numWorkers := cobrautil.MustGetInt(cmd, "workers")
+	objective := thumperrunner.CapacityObjective{
+		MaxP99Latency: cobrautil.MustGetDuration(cmd, "max-p99-latency"),
+		MaxErrorRate:  cobrautil.MustGetFloat64(cmd, "max-error-rate"),
+	}
+	searchOptions := thumperrunner.CapacitySearchOptions{
+		StartQPS:  cobrautil.MustGetFloat64(cmd, "start-qps"),
+		MaxQPS:    cobrautil.MustGetFloat64(cmd, "max-qps"),
+		Growth:    cobrautil.MustGetFloat64(cmd, "growth"),
+		Precision: cobrautil.MustGetFloat64(cmd, "precision"),
+	}
+
+	switch {
+	case searchOptions.StartQPS <= 0 || searchOptions.MaxQPS < searchOptions.StartQPS:
+		return errors.New("start-qps must be positive and no higher than max-qps")
+	case searchOptions.Growth <= 1:
+		return errors.New("growth must be greater than 1")
+	case searchOptions.Precision <= 0:
+		return errors.New("precision must be positive")
+	case stepDuration <= 0:
+		return errors.New("step-duration must be positive")
+	case numWorkers < 1:
+		return fmt.Errorf("workers must be at least 1, got %d", numWorkers)
+	}
+
+	arrival, err := thumperrunner.ParseArrivalMode(cobrautil.MustGetString(cmd, "arrival"))
+	if err != nil {
+		return err
+	}
+
+	files, err := readScriptFiles(args)
+	if err != nil {
+		return err
+	}
+
+	seed := seedFromFlags(cmd)
+	workerScripts, err := loadWorkerScripts(cmd, files, numWorkers, seed)
+	if err != nil {
+		return err
+	}
+
+	clients, err := clientPoolFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	results := thumperrunner.NewResults()
+	workers, err := createWorkers(cmd, workerScripts, clients, results, nil, nil, nil, seed)
+	if err != nil {
+		return err
+	}
+
+	stopMetricsServer := startMetricsServer(cmd)
+	defer stopMetricsServer()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	limits := thumperrunner.RunLimits{
+		Duration:     stepDuration,
+		DrainTimeout: cobrautil.MustGetDuration(cmd, "drain-timeout"),
+	}
+
+	search := thumperrunner.NewCapacitySearch(searchOptions)
+	var windows []capacityWindow
+	for rate, ok := search.Next(); ok; rate, ok = search.Next() {
+		results.Reset()
+
+		start := time.Now()
+		thumperrunner.NewScheduler(thumperrunner.SchedulerOptions{
+			Workers: workers,
+			QPS:     rate,
+			Arrival: arrival,
+			Limits:  limits,
+			Rand:    thumperrunner.NewRand(thumperrunner.DeriveSeed(seed, "scheduler", len(windows))),
+		}).Run(ctx)
+		elapsed := time.Since(start)
+
+		if ctx.Err() != nil {
+			log.Warn().Msg("capacity search interrupted")
+			if err := printCapacityWindows(cmd.OutOrStdout(), windows); err != nil {
+				return err
+			}
+			return errors.New("capacity search interrupted")
+		}
+
+		summaries := results.Summary()
+		total := summaries[len(summaries)-1]
+		window := capacityWindow{
+			target:   rate,
+			achieved: float64(total.Count) / elapsed.Seconds(),
+			summary:  total,
+			passed:   objective.Met(total),
+		}
+		windows = append(windows, window)
+
+		log.Info().
+			Float64("target-qps", window.target).
+			Float64("achieved-qps", window.achieved).
+			Dur("p99", total.Response.P99).
+			Float64("error-rate", total.ErrorRate()).
+			Bool("passed", window.passed).
+			Msg("finished step window")
+
+		search.Report(window.passed)
+	}
+
+	if err := printCapacityWindows(cmd.OutOrStdout(), windows); err != nil {
+		return err
+	}
+
+	knee := search.Knee()
+	if knee == 0 {
+		return fmt.Errorf("no rate met the objective, starting from %.1f qps", searchOptions.StartQPS)
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "\nhighest rate meeting the objective: %.1f qps\n", knee)
+	return nil
+}
+
+// printCapacityWindows writes the outcome of each step window as a table.
+func printCapacityWindows(out io.Writer, windows []capacityWindow) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TARGET QPS\tACHIEVED QPS\tP50\tP99\tERROR RATE\tRESULT")
+	for _, window := range windows {
+		result := "fail"
+		if window.passed {
+			result = "pass"
+		}
+
+		fmt.Fprintf(w, "%.1f\t%.1f\t%s\t%s\t%.2f%%\t%s\n",
+			window.target,
+			window.achieved,
+			window.summary.Response.P50.Round(time.Microsecond),
+			window.summary.Response.P99.Round(time.Microsecond),
+			window.summary.ErrorRate()*100,
+			result,
+		)
+	}
+	return w.Flush()
+}
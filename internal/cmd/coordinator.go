@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/distributed"
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/jzelinskie/cobrautil/v2"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+)
+
+func RegisterCoordinatorFlags(cmd *cobra.Command) {
+	cmd.Flags().String("listen", ":50055", "address on which to accept agents")
+	cmd.Flags().Int("agents", 1, "number of agents to wait for before starting the run")
+	cmd.Flags().Duration("join-timeout", 5*time.Minute, "how long to wait for agents to join")
+	cmd.Flags().Float64("qps", 1, "queries per second to generate across all agents")
+	cmd.Flags().String("arrival", string(thumperrunner.ArrivalFixed), "how requests are spaced over time: fixed, uniform, or poisson")
+	cmd.Flags().Int64("seed", 0, "seed for every random choice, from which each agent derives its own (0 for a new seed, which is logged)")
+	cmd.Flags().Duration("duration", 0, "stop issuing requests after this long (0 for no limit)")
+	cmd.Flags().Int("requests", 0, "stop after issuing this many requests across all agents (0 for no limit)")
+	cmd.Flags().Duration("start-delay", 5*time.Second, "time agents are given to prepare the scripts before they start at the same time")
+	cmd.Flags().Duration("report-timeout", 30*time.Second, "how long to wait for agents to report their results once stopped")
+}
+
+var CoordinatorCmd = &cobra.Command{
+	Use:   "coordinator script.yaml [script2.yaml] [script3.yaml]",
+	Short: "distribute a run over several agents",
+	Example: `
+	Generate 50000 queries per second for ten minutes with five agents:
+		thumper coordinator ./scripts/script.yaml --agents 5 --qps 50000 --duration 10m
+
+	Then start each agent against the SpiceDB under test:
+		thumper agent --coordinator coordinator.example.com:50055 --token "testtesttesttest" --endpoint spicedb.example.com:50051
+	`,
+	Args:    cobra.MinimumNArgs(1),
+	RunE:    coordinatorCmdFunc,
+	PreRunE: DefaultPreRunE("thumper"),
+}
+
+func coordinatorCmdFunc(cmd *cobra.Command, args []string) error {
+	numAgents := cobrautil.MustGetInt(cmd, "agents")
+	startDelay := cobrautil.MustGetDuration(cmd, "start-delay")
+	plan := distributed.Plan{
+		QPS:           cobrautil.MustGetFloat64(cmd, "qps"),
+		Duration:      cobrautil.MustGetDuration(cmd, "duration"),
+		Requests:      cobrautil.MustGetInt(cmd, "requests"),
+		StartDelay:    startDelay,
+		ReportTimeout: cobrautil.MustGetDuration(cmd, "report-timeout"),
+		Seed:          seedFromFlags(cmd),
+	}
+
+	switch {
+	case numAgents < 1:
+		return fmt.Errorf("agents must be at least 1, got %d", numAgents)
+	case plan.QPS <= 0:
+		return errors.New("qps must be positive")
+	case plan.Duration < 0 || plan.Requests < 0:
+		return errors.New("run limits must not be negative")
+	}
+
+	arrival, err := thumperrunner.ParseArrivalMode(cobrautil.MustGetString(cmd, "arrival"))
+	if err != nil {
+		return err
+	}
+	plan.Arrival = arrival
+
+	plan.Scripts, err = readScriptFiles(args)
+	if err != nil {
+		return err
+	}
+
+	lis, err := net.Listen("tcp", cobrautil.MustGetString(cmd, "listen"))
+	if err != nil {
+		return fmt.Errorf("unable to listen for agents: %w", err)
+	}
+
+	server := grpc.NewServer()
+	coordinator := distributed.NewCoordinator()
+	coordinator.Register(server)
+	go func() {
+		if err := server.Serve(lis); err != nil {
+			log.Fatal().Err(err).Msg("failed while serving agents")
+		}
+	}()
+	defer stopServer(server)
+
+	log.Info().Str("address", lis.Addr().String()).Int("agents", numAgents).Msg("accepting agents")
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	joinCtx, cancelJoin := context.WithTimeout(ctx, cobrautil.MustGetDuration(cmd, "join-timeout"))
+	defer cancelJoin()
+	if err := coordinator.WaitForAgents(joinCtx, numAgents); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	results, agentResults, runErr := coordinator.Run(ctx, plan)
+	elapsed := max(time.Since(start)-startDelay, time.Millisecond)
+
+	var failed int
+	for _, agentResult := range agentResults {
+		if agentResult.Error != "" {
+			log.Error().Str("agent", agentResult.Name).Str("error", agentResult.Error).Msg("agent failed")
+			failed++
+		}
+	}
+
+	if results != nil {
+		if err := printSummary(cmd.OutOrStdout(), "", results.Summary(), elapsed); err != nil {
+			return err
+		}
+	}
+
+	if runErr != nil {
+		return runErr
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d agents failed", failed, len(agentResults))
+	}
+	return nil
+}
+
+// stopServer lets agents receive the responses to their reports and the end
+// of their command streams, but does not wait on agents that never took part.
+func stopServer(server *grpc.Server) {
+	stopped := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		server.Stop()
+	}
+}
@@ -16,6 +16,10 @@ import (
 	"google.golang.org/grpc/credentials/insecure"
 )
 
+func RegisterMigrateFlags(cmd *cobra.Command) {
+	cmd.Flags().Int64("seed", 0, "seed for every random choice, which makes migrations with the same seed issue the same requests (0 for a new seed, which is logged)")
+}
+
 var MigrateCmd = &cobra.Command{
 	Use:   "migrate migration.yaml [migration2.yaml] [migration3.yaml]",
 	Short: "run setup scripts",
@@ -38,6 +42,8 @@ func migrateCmdFunc(cmd *cobra.Command, args []string) error {
 	client := clientFromFlags(cmd)
 	psName := cobrautil.MustGetString(cmd, "permissions-system")
 
+	rng := thumperrunner.NewRand(seedFromFlags(cmd))
+
 	// Load the migration scripts
 	var preparedScripts []*thumperrunner.ExecutableScript
 	for _, scriptFilename := range args {
@@ -48,7 +54,7 @@ func migrateCmdFunc(cmd *cobra.Command, args []string) error {
 			scriptVars.Prefix = fmt.Sprintf("%s/", psName)
 		}
 
-		fileScripts, _, err := thumperconf.Load(scriptFilename, scriptVars)
+		fileScripts, _, err := thumperconf.Load(scriptFilename, scriptVars, rng)
 		if err != nil {
 			return fmt.Errorf("unable to load script file: %w", err)
 		}
@@ -61,9 +67,12 @@ func migrateCmdFunc(cmd *cobra.Command, args []string) error {
 		preparedScripts = append(preparedScripts, preparedFileScripts...)
 	}
 
+	ctx, cancel := signalContext()
+	defer cancel()
+
 	// Run the scripts in order
 	for _, script := range preparedScripts {
-		if err := script.RunOnce(client); err != nil {
+		if err := script.RunOnce(ctx, client, rng); err != nil {
 			return fmt.Errorf("error running migration scripts: %w", err)
 		}
 	}
@@ -1,14 +1,22 @@
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"sync"
+	"math"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	thumperconf "github.com/authzed/internal/thumper/internal/config"
+	"github.com/authzed/internal/thumper/internal/control"
 	"github.com/authzed/internal/thumper/internal/thumperrunner"
 
 	"github.com/KimMachineGun/automemlimit/memlimit"
+	"github.com/authzed/authzed-go/v1"
 	"github.com/go-logr/logr"
 	"github.com/jzelinskie/cobrautil/v2"
 	"github.com/jzelinskie/cobrautil/v2/cobrahttp"
@@ -30,15 +38,50 @@ var (
 		cobrahttp.WithFlagPrefix("metrics"),
 		cobrahttp.WithDefaultEnabled(true),
 		cobrahttp.WithHandler(promhttp.Handler()))
+
+	// ControlServerBuilder serves the control API of a run, whose handler is
+	// only known once the run has been set up.
+	ControlServerBuilder = cobrahttp.New("control",
+		cobrahttp.WithDefaultAddress(":9091"),
+		cobrahttp.WithFlagPrefix("control"),
+		cobrahttp.WithDefaultEnabled(false))
+)
+
+const (
+	modeOpen   = "open"
+	modeClosed = "closed"
 )
 
+// maxDefaultWorkers caps the number of workers created when none are requested.
+const maxDefaultWorkers = 100
+
 func RegisterRunFlags(cmd *cobra.Command) {
+	cmd.Flags().String("mode", modeOpen, "open to issue requests at a target rate, closed to run a fixed number of concurrent virtual users")
 	cmd.Flags().Int("qps", 1, "queries per second to generate")
+	cmd.Flags().Int("concurrency", 1, "number of virtual users in closed mode")
+	cmd.Flags().Int("workers", 0, "number of workers in open mode, each with its own copy of the scripts (0 for one per query per second, up to 100)")
+	cmd.Flags().Int("connections", 4, "number of connections to SpiceDB, shared by all workers")
+	cmd.Flags().Duration("think-time", 0, "time each virtual user waits between steps in closed mode")
 	cmd.Flags().Duration("step-timeout", 500*time.Millisecond, "maximum time a single step is allowed to run")
 	cmd.Flags().Bool("randomize-starting-step", false, "randomize the starting script step for each worker")
+	cmd.Flags().Int64("seed", 0, "seed for every random choice, which makes runs with the same seed and flags issue the same requests (0 for a new seed, which is logged)")
+	cmd.Flags().String("arrival", string(thumperrunner.ArrivalFixed), "how requests are spaced over time: fixed, uniform, or poisson")
+	cmd.Flags().String("profile", "", "load profile file that varies the rate over time, starting from --qps")
+	cmd.Flags().Duration("duration", 0, "stop issuing requests after this long (0 for no limit)")
+	cmd.Flags().Int("requests", 0, "stop after issuing this many requests in total (0 for no limit)")
+	cmd.Flags().Int("iterations", 0, "stop after running every script this many times from start to end (0 for no limit)")
+	cmd.Flags().Duration("drain-timeout", 10*time.Second, "how long steps in flight when the run stops are given to finish before they are cancelled (0 to wait for all of them)")
+	cmd.Flags().Float64("breaker-error-rate", 0, "trip the circuit breaker when more than this fraction of steps fail over the breaker window (0 to disable)")
+	cmd.Flags().Duration("breaker-window", 30*time.Second, "trailing period over which the circuit breaker measures the error rate")
+	cmd.Flags().Int("breaker-min-requests", 20, "number of steps the breaker window must hold before the circuit breaker can trip")
+	cmd.Flags().String("breaker-action", string(thumperrunner.BreakerAbort), "what the circuit breaker does when it trips: abort to stop the run with an error, or pause to resume after the cooldown")
+	cmd.Flags().Duration("breaker-cooldown", 30*time.Second, "how long a run paused by the circuit breaker waits before resuming")
+	cmd.Flags().StringSlice("watch-object-types", nil, "follow the Watch API for relationships of these resource types, and measure how long written relationships take to arrive (empty to disable)")
+	cmd.Flags().Duration("watch-max-lag", thumperrunner.DefaultWatchMaxLag, "how long a written relationship is waited for on the Watch API before it is counted as unmatched")
 
 	// Register http flags
-	MetricsServerBuilder.RegisterFlags(cmd.Flags())
+	registerMetricsFlags(cmd)
+	ControlServerBuilder.RegisterFlags(cmd.Flags())
 }
 
 var RunCmd = &cobra.Command{
@@ -53,6 +96,25 @@ var RunCmd = &cobra.Command{
 	
 	Run with environment variables:
 		THUMPER_TOKEN=testtesttesttest thumper run ./scripts/script.yaml
+
+	Run for five minutes and print a summary:
+		thumper run ./scripts/script.yaml --token "testtesttesttest" --duration 5m
+
+	Run at 5000 queries per second with 50 workers sharing 8 connections:
+		thumper run ./scripts/script.yaml --token "testtesttesttest" --qps 5000 --workers 50 --connections 8
+
+	Run with the control API enabled, and double the rate while it runs:
+		thumper run ./scripts/script.yaml --token "testtesttesttest" --qps 100 --control-enabled
+		curl -X PUT localhost:9091/qps -d '{"qps": 200}'
+
+	Run a soak test that stops with an error if more than 5% of steps fail over a minute:
+		thumper run ./scripts/script.yaml --token "testtesttesttest" --duration 12h --breaker-error-rate 0.05 --breaker-window 1m
+
+	Run 50 concurrent virtual users to measure maximum throughput:
+		thumper run ./scripts/script.yaml --token "testtesttesttest" --mode closed --concurrency 50 --duration 5m
+
+	Measure how long written documents take to arrive over the Watch API:
+		thumper run ./scripts/script.yaml --token "testtesttesttest" --watch-object-types document
 	`,
 	Args:    cobra.MinimumNArgs(1),
 	RunE:    runCmdFunc,
@@ -60,37 +122,260 @@ var RunCmd = &cobra.Command{
 }
 
 func runCmdFunc(cmd *cobra.Command, args []string) error {
+	mode := cobrautil.MustGetString(cmd, "mode")
 	qps := cobrautil.MustGetInt(cmd, "qps")
-	stepTimeout := cobrautil.MustGetDuration(cmd, "step-timeout")
-	stepRandomization := cobrautil.MustGetBool(cmd, "randomize-starting-step")
+	concurrency := cobrautil.MustGetInt(cmd, "concurrency")
 	psName := cobrautil.MustGetString(cmd, "permissions-system")
-	log.Info().Int("qps", qps).Str("permission-system", psName).Msg("starting run command")
+	log.Info().Str("mode", mode).Int("qps", qps).Str("permission-system", psName).Msg("starting run command")
+
+	// Every virtual user in closed mode gets a worker of its own, so that its
+	// steps are never executed concurrently with each other.
+	var numWorkers int
+	switch mode {
+	case modeOpen:
+		if qps < 1 {
+			return fmt.Errorf("qps must be at least 1, got %d", qps)
+		}
+		numWorkers = numWorkersForRate(cobrautil.MustGetInt(cmd, "workers"), float64(qps))
+	case modeClosed:
+		if concurrency < 1 {
+			return fmt.Errorf("concurrency must be at least 1, got %d", concurrency)
+		}
+		if cobrautil.MustGetString(cmd, "profile") != "" {
+			return errors.New("load profiles are not supported in closed mode")
+		}
+		if cmd.Flags().Changed("workers") {
+			return errors.New("workers cannot be set in closed mode, where every virtual user has a worker of its own")
+		}
+		if cobrautil.MustGetBool(cmd, "control-enabled") {
+			return errors.New("the control API is not supported in closed mode")
+		}
+		numWorkers = concurrency
+	default:
+		return fmt.Errorf("unknown mode: %s", mode)
+	}
+	if numWorkers < 1 {
+		return fmt.Errorf("workers must be at least 1, got %d", numWorkers)
+	}
+
+	limits := thumperrunner.RunLimits{
+		Duration:     cobrautil.MustGetDuration(cmd, "duration"),
+		Requests:     cobrautil.MustGetInt(cmd, "requests"),
+		DrainTimeout: cobrautil.MustGetDuration(cmd, "drain-timeout"),
+	}
+	iterations := cobrautil.MustGetInt(cmd, "iterations")
+	if limits.Duration < 0 || limits.Requests < 0 || limits.DrainTimeout < 0 || iterations < 0 {
+		return errors.New("run limits must not be negative")
+	}
+
+	arrival, err := thumperrunner.ParseArrivalMode(cobrautil.MustGetString(cmd, "arrival"))
+	if err != nil {
+		return err
+	}
+
+	var profile *thumperrunner.RateProfile
+	if profileFilename := cobrautil.MustGetString(cmd, "profile"); profileFilename != "" {
+		loaded, err := thumperconf.LoadProfile(profileFilename)
+		if err != nil {
+			return fmt.Errorf("unable to load profile file: %w", err)
+		}
+
+		profile, err = thumperrunner.NewRateProfile(loaded, float64(qps))
+		if err != nil {
+			return fmt.Errorf("invalid load profile: %w", err)
+		}
+	}
 
+	breaker, err := breakerFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+
+	files, err := readScriptFiles(args)
+	if err != nil {
+		return err
+	}
+
+	seed := seedFromFlags(cmd)
+	workerScripts, err := loadWorkerScripts(cmd, files, numWorkers, seed)
+	if err != nil {
+		return err
+	}
+
+	if iterations > 0 {
+		limits.Iterations = thumperrunner.NewIterationBudget(workerScripts[0], iterations)
+	}
+
+	if pinned := thumperrunner.PinnedQPS(workerScripts[0]); pinned > 0 {
+		if mode == modeClosed {
+			return errors.New("scripts with a qps of their own are not supported in closed mode")
+		}
+		if pinned > float64(qps) {
+			log.Warn().Float64("pinned-qps", pinned).Int("qps", qps).Msg("scripts with a qps of their own exceed the target rate, so no other scripts will run")
+		}
+	}
+
+	clients, err := clientPoolFromFlags(cmd)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	// The watcher gets a connection of its own, so that its stream does not
+	// hold up the steps of the workers.
+	var watcher *thumperrunner.Watcher
+	if objectTypes := cobrautil.MustGetStringSlice(cmd, "watch-object-types"); len(objectTypes) > 0 {
+		watchClient := clientFromFlags(cmd)
+		defer watchClient.Close()
+
+		watcher, err = thumperrunner.NewWatcher(thumperrunner.WatcherOptions{
+			Client:      watchClient,
+			ObjectTypes: objectTypes,
+			MaxLag:      cobrautil.MustGetDuration(cmd, "watch-max-lag"),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	results := thumperrunner.NewResults()
+	workers, err := createWorkers(cmd, workerScripts, clients, results, limits.Iterations, breaker, watcher, seed)
+	if err != nil {
+		return err
+	}
+
+	stopMetricsServer := startMetricsServer(cmd)
+	defer stopMetricsServer()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	var runner interface {
+		thumperrunner.BreakerTarget
+		Run(ctx context.Context) string
+	}
+	if mode == modeClosed {
+		runner = thumperrunner.NewClosedLoop(thumperrunner.ClosedLoopOptions{
+			Workers:     workers,
+			Concurrency: concurrency,
+			ThinkTime:   cobrautil.MustGetDuration(cmd, "think-time"),
+			Limits:      limits,
+		})
+	} else {
+		scheduler := thumperrunner.NewScheduler(thumperrunner.SchedulerOptions{
+			Workers: workers,
+			QPS:     float64(qps),
+			Arrival: arrival,
+			Profile: profile,
+			Limits:  limits,
+			Rand:    thumperrunner.NewRand(thumperrunner.DeriveSeed(seed, "scheduler", 0)),
+		})
+		startControlServer(cmd, thumperrunner.NewController(scheduler, workers))
+		runner = scheduler
+	}
+
+	if breaker != nil {
+		stopBreaker := make(chan struct{})
+		defer close(stopBreaker)
+		go breaker.Watch(runner, stopBreaker)
+	}
+
+	if watcher != nil {
+		watchCtx, stopWatcher := context.WithCancel(ctx)
+		defer stopWatcher()
+		go watcher.Run(watchCtx)
+	}
+
+	start := time.Now()
+	reason := runner.Run(ctx)
+	log.Info().Msg("terminating")
+
+	if err := printSummary(cmd.OutOrStdout(), reason, results.Summary(), time.Since(start)); err != nil {
+		return err
+	}
+
+	if breaker != nil {
+		return breaker.Tripped()
+	}
+	return nil
+}
+
+// breakerFromFlags creates the circuit breaker configured by the flags, or
+// returns nil if it is disabled.
+func breakerFromFlags(cmd *cobra.Command) (*thumperrunner.CircuitBreaker, error) {
+	maxErrorRate := cobrautil.MustGetFloat64(cmd, "breaker-error-rate")
+	if maxErrorRate == 0 {
+		return nil, nil
+	}
+
+	action, err := thumperrunner.ParseBreakerAction(cobrautil.MustGetString(cmd, "breaker-action"))
+	if err != nil {
+		return nil, err
+	}
+
+	return thumperrunner.NewCircuitBreaker(thumperrunner.CircuitBreakerOptions{
+		MaxErrorRate: maxErrorRate,
+		Window:       cobrautil.MustGetDuration(cmd, "breaker-window"),
+		MinRequests:  cobrautil.MustGetInt(cmd, "breaker-min-requests"),
+		Action:       action,
+		Cooldown:     cobrautil.MustGetDuration(cmd, "breaker-cooldown"),
+	})
+}
+
+// seedFromFlags returns the seed given by the flags, or a new one if none was
+// given. Either way it is logged, so that the run can be repeated.
+func seedFromFlags(cmd *cobra.Command) int64 {
+	seed := cobrautil.MustGetInt64(cmd, "seed")
+	if seed == 0 {
+		seed = thumperrunner.NewSeed()
+	}
+
+	log.Info().Int64("seed", seed).Msg("seeded random choices")
+	return seed
+}
+
+// readScriptFiles reads the given script files without rendering them.
+func readScriptFiles(filenames []string) ([]thumperconf.ScriptFile, error) {
+	files := make([]thumperconf.ScriptFile, 0, len(filenames))
+	for _, filename := range filenames {
+		file, err := thumperconf.ReadScriptFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load script file: %w", err)
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// loadWorkerScripts renders and prepares the script files, one copy per worker.
+// Every worker renders its copy with a generator of its own derived from the
+// seed.
+func loadWorkerScripts(cmd *cobra.Command, files []thumperconf.ScriptFile, numWorkers int, seed int64) ([][]*thumperrunner.ExecutableScript, error) {
 	scriptVars := thumperconf.ScriptVariables{}
-	if psName != "" {
+	if psName := cobrautil.MustGetString(cmd, "permissions-system"); psName != "" {
 		scriptVars.Prefix = fmt.Sprintf("%s/", psName)
 	}
 
 	// Keep track of the total stats for all workers
 	var scriptsForStats []*thumperconf.Script
 
-	scriptCache := make(map[string][]*thumperrunner.ExecutableScript, len(args))
+	scriptCache := make(map[int][]*thumperrunner.ExecutableScript, len(files))
 
-	// Load the scripts and transform them, one copy per worker
-	workerScripts := make([][]*thumperrunner.ExecutableScript, 0, qps)
-	for i := 0; i < qps; i++ {
+	workerScripts := make([][]*thumperrunner.ExecutableScript, 0, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		rng := thumperrunner.NewRand(thumperrunner.DeriveSeed(seed, "scripts", i))
 		var preparedScripts []*thumperrunner.ExecutableScript
-		for _, scriptFilename := range args {
-			if cached, ok := scriptCache[scriptFilename]; ok {
+		for fileIndex, file := range files {
+			if cached, ok := scriptCache[fileIndex]; ok {
 				preparedScripts = append(preparedScripts, cached...)
 
-				// Skip actually loading it from disk
+				// Skip actually rendering it again
 				continue
 			}
 
-			fileScripts, usedRandom, err := thumperconf.Load(scriptFilename, scriptVars)
+			fileScripts, usedRandom, err := thumperconf.Parse(file, scriptVars, rng)
 			if err != nil {
-				return fmt.Errorf("unable to load script file: %w", err)
+				return nil, fmt.Errorf("unable to load script file: %w", err)
 			}
 
 			if i == 0 {
@@ -99,11 +384,11 @@ func runCmdFunc(cmd *cobra.Command, args []string) error {
 
 			preparedFileScripts, err := thumperrunner.Prepare(fileScripts)
 			if err != nil {
-				return fmt.Errorf("error preparing scripts for execution: %w", err)
+				return nil, fmt.Errorf("error preparing scripts for execution: %w", err)
 			}
 
 			if !usedRandom {
-				scriptCache[scriptFilename] = preparedFileScripts
+				scriptCache[fileIndex] = preparedFileScripts
 			}
 
 			preparedScripts = append(preparedScripts, preparedFileScripts...)
@@ -116,40 +401,119 @@ func runCmdFunc(cmd *cobra.Command, args []string) error {
 		log.Info().Float32("probability", probability).Str("op", op).Msg("op probability")
 	}
 
-	//	Kick off the workers.
-	//	TODO(jschorr): Add automatic disconnect if we start receiving too many errors.
-	var wg sync.WaitGroup
-	timeBetween := time.Duration(1) * time.Second / time.Duration(qps)
-	for i := 0; i < qps; i++ {
-		wg.Add(1)
-		index := i
-		go (func() {
-			defer wg.Done()
-
-			client := clientFromFlags(cmd)
-			thumperrunner.RunWorker(thumperrunner.WorkerOptions{
-				Index:             index,
-				Client:            client,
-				Scripts:           workerScripts[index],
-				StepTimeout:       stepTimeout,
-				StepRandomization: stepRandomization,
-			})
-		})()
-		time.Sleep(timeBetween)
-	}
-
-	// Start the metrics endpoint.
+	return workerScripts, nil
+}
+
+// numWorkersForRate returns the requested number of workers, or one per query
+// per second up to maxDefaultWorkers when none were requested.
+func numWorkersForRate(requested int, qps float64) int {
+	if requested != 0 {
+		return requested
+	}
+	return max(1, min(maxDefaultWorkers, int(math.Ceil(qps))))
+}
+
+// clientPoolFromFlags opens the number of connections requested by the flags.
+func clientPoolFromFlags(cmd *cobra.Command) (*thumperrunner.ClientPool, error) {
+	numConnections := cobrautil.MustGetInt(cmd, "connections")
+	if numConnections < 1 {
+		return nil, fmt.Errorf("connections must be at least 1, got %d", numConnections)
+	}
+
+	clients := make([]*authzed.Client, 0, numConnections)
+	for i := 0; i < numConnections; i++ {
+		clients = append(clients, clientFromFlags(cmd))
+	}
+
+	log.Info().Int("connections", numConnections).Msg("connected to SpiceDB")
+
+	return thumperrunner.NewClientPool(clients...), nil
+}
+
+// createWorkers creates one worker per set of scripts, all sharing the pool of
+// clients, each with a generator of its own derived from the seed.
+func createWorkers(cmd *cobra.Command, workerScripts [][]*thumperrunner.ExecutableScript, clients *thumperrunner.ClientPool, results *thumperrunner.Results, budget *thumperrunner.IterationBudget, breaker *thumperrunner.CircuitBreaker, watcher *thumperrunner.Watcher, seed int64) ([]*thumperrunner.Worker, error) {
+	stepTimeout := cobrautil.MustGetDuration(cmd, "step-timeout")
+	stepRandomization := cobrautil.MustGetBool(cmd, "randomize-starting-step")
+
+	workers := make([]*thumperrunner.Worker, 0, len(workerScripts))
+	for i, scripts := range workerScripts {
+		worker, err := thumperrunner.NewWorker(thumperrunner.WorkerOptions{
+			Index:             i,
+			Clients:           clients,
+			Scripts:           scripts,
+			StepTimeout:       stepTimeout,
+			StepRandomization: stepRandomization,
+			Results:           results,
+			Budget:            budget,
+			Breaker:           breaker,
+			Watcher:           watcher,
+			Rand:              thumperrunner.NewRand(thumperrunner.DeriveSeed(seed, "worker", i)),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("unable to create worker: %w", err)
+		}
+		workers = append(workers, worker)
+	}
+
+	return workers, nil
+}
+
+// registerMetricsFlags registers the flags of the metrics server.
+func registerMetricsFlags(cmd *cobra.Command) {
+	MetricsServerBuilder.RegisterFlags(cmd.Flags())
+	cmd.Flags().Duration("metrics-linger", 0, "keep serving metrics this long after the run has drained, so that a final scrape sees every step")
+}
+
+// startMetricsServer starts serving metrics in the background. The returned
+// function keeps serving them for the linger period, and then shuts the
+// server down.
+func startMetricsServer(cmd *cobra.Command) func() {
 	metricsSrv := MetricsServerBuilder.ServerFromFlags(cmd)
 	go func() {
-		if err := MetricsServerBuilder.ListenFromFlags(cmd, metricsSrv); err != nil {
+		if err := MetricsServerBuilder.ListenFromFlags(cmd, metricsSrv); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			log.Fatal().Err(err).Msg("failed while serving metrics")
 		}
 	}()
 
-	wg.Wait()
-	log.Info().Msg("terminating")
+	return func() {
+		if !cobrautil.MustGetBool(cmd, "metrics-enabled") {
+			return
+		}
 
-	return nil
+		if linger := cobrautil.MustGetDuration(cmd, "metrics-linger"); linger > 0 {
+			log.Info().Dur("linger", linger).Msg("serving final metrics")
+			time.Sleep(linger)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := metricsSrv.Shutdown(ctx); err != nil {
+			log.Warn().Err(err).Msg("unable to shut down metrics server")
+		}
+	}
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM.
+// Once cancelled, a second signal terminates the process right away.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	return ctx, stop
+}
+
+// startControlServer serves the control API for the run in the background.
+func startControlServer(cmd *cobra.Command, target control.Target) {
+	controlSrv := ControlServerBuilder.ServerFromFlags(cmd)
+	controlSrv.Handler = control.NewHandler(target)
+	go func() {
+		if err := ControlServerBuilder.ListenFromFlags(cmd, controlSrv); err != nil {
+			log.Fatal().Err(err).Msg("failed while serving control API")
+		}
+	}()
 }
 
 // DefaultPreRunE sets up viper, zerolog, and OpenTelemetry flag handling for a command.
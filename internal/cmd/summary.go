@@ -0,0 +1,48 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+)
+
+// printSummary writes why a run stopped, if known, and the per-operation
+// results of a run that lasted for the given time as a table, followed by a
+// table of service times.
+func printSummary(out io.Writer, reason string, summaries []thumperrunner.OpSummary, elapsed time.Duration) error {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if reason != "" {
+		fmt.Fprintf(w, "stopped: %s after %s\n\n", reason, elapsed.Round(time.Millisecond))
+	}
+	fmt.Fprintln(w, "OP\tCOUNT\tQPS\tERRORS\tERROR RATE\tMEAN\tP50\tP90\tP99\tMAX")
+	for _, summary := range summaries {
+		fmt.Fprintf(w, "%s\t%d\t%.1f\t%d\t%.2f%%\t%s\n",
+			summary.Op,
+			summary.Count,
+			float64(summary.Count)/elapsed.Seconds(),
+			summary.Errors,
+			summary.ErrorRate()*100,
+			latencyColumns(summary.Response),
+		)
+	}
+
+	fmt.Fprintln(w, "\nSERVICE TIME\t\t\t\t\tMEAN\tP50\tP90\tP99\tMAX")
+	for _, summary := range summaries {
+		fmt.Fprintf(w, "%s\t\t\t\t\t%s\n", summary.Op, latencyColumns(summary.Service))
+	}
+
+	return w.Flush()
+}
+
+func latencyColumns(latency thumperrunner.LatencySummary) string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s\t%s",
+		latency.Mean.Round(time.Microsecond),
+		latency.P50.Round(time.Microsecond),
+		latency.P90.Round(time.Microsecond),
+		latency.P99.Round(time.Microsecond),
+		latency.Max.Round(time.Microsecond),
+	)
+}
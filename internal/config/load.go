@@ -16,19 +16,49 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// Load reads a script file, replaces the templated values with the values from
-// the execution environment, and then processes it as a thumper script yaml.
-func Load(filename string, vars ScriptVariables) ([]*Script, bool, error) {
-	usedRandom := false
-	randomID := randomObjectID(64)
+// ScriptFile is the unrendered contents of a script file.
+type ScriptFile struct {
+	Name     string
+	Contents string
+}
 
+// ReadScriptFile reads a script file without rendering it, so that it can be
+// rendered later, possibly by another process.
+func ReadScriptFile(filename string) (ScriptFile, error) {
 	// Look for the file in the given path *or* in the kodata dir
 	filepath, err := findFile(filename, os.Getenv("KO_DATA_PATH"))
+	if err != nil {
+		return ScriptFile{}, err
+	}
+
+	contents, err := os.ReadFile(filepath)
+	if err != nil {
+		return ScriptFile{}, fmt.Errorf("unable to read script %s: %w", filepath, err)
+	}
+
+	return ScriptFile{Name: path.Base(filepath), Contents: string(contents)}, nil
+}
+
+// Load reads a script file, replaces the templated values with the values from
+// the execution environment, and then processes it as a thumper script yaml.
+func Load(filename string, vars ScriptVariables, rng *rand.Rand) ([]*Script, bool, error) {
+	file, err := ReadScriptFile(filename)
 	if err != nil {
 		return nil, false, err
 	}
 
-	tmpl := template.New(path.Base(filepath)).Funcs(template.FuncMap{
+	return Parse(file, vars, rng)
+}
+
+// Parse renders the contents of a script file and processes it as a thumper
+// script yaml. It also returns whether the script used randomObjectID, in which
+// case every rendering of it results in different scripts. Random object IDs
+// are drawn from the given generator.
+func Parse(file ScriptFile, vars ScriptVariables, rng *rand.Rand) ([]*Script, bool, error) {
+	usedRandom := false
+	randomID := RandomObjectID(rng, 64)
+
+	tmpl := template.New(file.Name).Funcs(template.FuncMap{
 		"enumerate": func(count uint) []uint {
 			indices := make([]uint, count)
 			for i := range indices {
@@ -47,9 +77,9 @@ func Load(filename string, vars ScriptVariables) ([]*Script, bool, error) {
 		},
 	}).Funcs(sprig.FuncMap())
 
-	parsed, err := tmpl.ParseFiles(filepath)
+	parsed, err := tmpl.Parse(file.Contents)
 	if err != nil {
-		return nil, false, fmt.Errorf("error parsing script %s: %w", filepath, err)
+		return nil, false, fmt.Errorf("error parsing script %s: %w", file.Name, err)
 	}
 
 	buf := &bytes.Buffer{}
@@ -83,18 +113,26 @@ const (
 	subsequentLetters = firstLetters + "/_|-"
 )
 
-func randomObjectID(length uint8) string {
+// RandomObjectID returns a random object ID of the given length drawn from the
+// given generator.
+func RandomObjectID(rng *rand.Rand, length uint8) string {
 	b := make([]byte, length)
 	for i := range b {
 		sourceLetters := subsequentLetters
 		if i == 0 {
 			sourceLetters = firstLetters
 		}
-		b[i] = sourceLetters[rand.Intn(len(sourceLetters))]
+		b[i] = sourceLetters[rng.Intn(len(sourceLetters))]
 	}
 	return string(b)
 }
 
+// FindFile returns the path of a file named by a script, which is either the
+// given path or the same path in the kodata directory.
+func FindFile(filename string) (string, error) {
+	return findFile(filename, os.Getenv("KO_DATA_PATH"))
+}
+
 // A pre-loaded file from the scripts dir is going to be put in the kodata
 // directory, which we don't want our users to have to find.
 // We first look for the file at the given path, then at
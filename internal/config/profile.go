@@ -0,0 +1,55 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/goccy/go-yaml"
+)
+
+// Profile is the top-level struct that load profile files will be deserialized
+// into. It describes how the target rate of a run changes over time.
+type Profile struct {
+	Repeat bool
+	Stages []ProfileStage
+}
+
+// ProfileStage is a single segment of a load profile.
+// Type can be ramp, hold, step, spike, or sine.
+type ProfileStage struct {
+	Type     string
+	Duration time.Duration
+
+	// From and To are the start and end rates of a ramp. When From is
+	// omitted, the ramp starts from the rate at the end of the previous stage.
+	From *float64
+	To   float64
+
+	// QPS is the rate of a step or spike, and the midpoint of a sine.
+	QPS float64
+
+	// Amplitude and Period shape a sine.
+	Amplitude float64
+	Period    time.Duration
+}
+
+// LoadProfile reads a load profile file.
+func LoadProfile(filename string) (*Profile, error) {
+	filepath, err := findFile(filename, os.Getenv("KO_DATA_PATH"))
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read profile %s: %w", filepath, err)
+	}
+
+	var profile Profile
+	if err := yaml.Unmarshal(contents, &profile); err != nil {
+		return nil, fmt.Errorf("unable to decode profile yaml: %w", err)
+	}
+
+	return &profile, nil
+}
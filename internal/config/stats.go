@@ -1,17 +1,26 @@
 package config
 
 // Stats returns the probability of any given operation being the one executed
-// on any given step. You can multiply it by QPS to get the per operation QPS.
+// on any given step picked by weight. You can multiply it by the QPS that is
+// left after the scripts with a QPS of their own, which are left out, to get
+// the per operation QPS.
+//
+// The steps of a control flow step count as a share of that step: a repeated
+// step counts once for every repetition, the branches of a choose by their
+// weight, and the branches of an if as half each, since whether the condition
+// holds is only known while running.
 func Stats(scripts []*Script) map[string]float32 {
 	opCounts := make(map[string]float32)
 	var totalCount uint
 
 	for _, script := range scripts {
+		if script.QPS > 0 {
+			continue
+		}
+
 		totalCount += script.Weight
 		singleOpCount := float32(script.Weight) / float32(len(script.Steps))
-		for _, step := range script.Steps {
-			opCounts[step.Op] += singleOpCount
-		}
+		countOps(script.Steps, singleOpCount, opCounts)
 	}
 
 	opToQPS := make(map[string]float32, len(opCounts))
@@ -21,3 +30,26 @@ func Stats(scripts []*Script) map[string]float32 {
 
 	return opToQPS
 }
+
+func countOps(steps []ScriptStep, share float32, opCounts map[string]float32) {
+	for _, step := range steps {
+		switch {
+		case step.Repeat > 0:
+			countOps(step.Steps, share*float32(step.Repeat), opCounts)
+		case len(step.Choose) > 0:
+			var totalWeight uint
+			for _, branch := range step.Choose {
+				totalWeight += branch.Weight
+			}
+			for _, branch := range step.Choose {
+				countOps(branch.Steps, share*float32(branch.Weight)/float32(totalWeight), opCounts)
+			}
+		case step.If != nil:
+			countOps(step.Steps, share/2, opCounts)
+			countOps(step.Else, share/2, opCounts)
+		case step.Op == "Sleep":
+		default:
+			opCounts[step.Op] += share
+		}
+	}
+}
@@ -107,6 +107,33 @@ func TestStats(t *testing.T) {
 				"write": 0.99,
 			},
 		},
+		{
+			[]*Script{
+				{
+					Weight: 1,
+					QPS:    50,
+					Steps:  []ScriptStep{{Op: "write"}},
+				},
+				{
+					Weight: 1,
+					Steps:  []ScriptStep{{Op: "check"}},
+				},
+			},
+			map[string]float32{
+				"check": 1.0,
+			},
+		},
+		{
+			[]*Script{
+				{
+					Weight: 1,
+					Steps:  []ScriptStep{{Op: "write"}, {Op: "Sleep"}},
+				},
+			},
+			map[string]float32{
+				"write": 0.5,
+			},
+		},
 		{
 			[]*Script{
 				{
@@ -139,6 +166,25 @@ func TestStats(t *testing.T) {
 				"write": 0.995,
 			},
 		},
+		{
+			[]*Script{
+				{
+					Weight: 1,
+					Steps: []ScriptStep{
+						{Repeat: 2, Steps: []ScriptStep{{Op: "check"}}},
+						{Choose: []Branch{
+							{Weight: 3, Steps: []ScriptStep{{Op: "read"}}},
+							{Weight: 1, Steps: []ScriptStep{{Op: "read"}, {Op: "write"}}},
+						}},
+					},
+				},
+			},
+			map[string]float32{
+				"check": 1.0,
+				"read":  0.5,
+				"write": 0.125,
+			},
+		},
 	}
 
 	for i, tc := range testCases {
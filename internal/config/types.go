@@ -2,6 +2,7 @@ package config
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/goccy/go-yaml"
 	"google.golang.org/protobuf/types/known/structpb"
@@ -11,7 +12,13 @@ import (
 type Script struct {
 	Name   string
 	Weight uint
-	Steps  []ScriptStep
+
+	// QPS runs the script at this absolute rate rather than by weight.
+	QPS float64 `yaml:"qps"`
+
+	// Mode is step, the default, or session, which runs every step in order.
+	Mode  string
+	Steps []ScriptStep
 }
 
 // ScriptStep is a single step of a thumper script, for example a single call to CheckPermissions.
@@ -30,6 +37,88 @@ type ScriptStep struct {
 	Schema               string
 	Consistency          string
 	Context              *ProtoStruct
+
+	// ExpectedResources and ExpectedSubjects are the exact object IDs a lookup must return.
+	ExpectedResources []string `yaml:"expectedResources"`
+	ExpectedSubjects  []string `yaml:"expectedSubjects"`
+
+	// ExpectedRelationships are the relationships a ReadRelationships step must return.
+	ExpectedRelationships []Relationship `yaml:"expectedRelationships"`
+
+	// Relationships, Count, and File are what an ImportBulkRelationships step
+	// loads, and File is where an ExportBulkRelationships step writes.
+	Relationships []Relationship
+	Count         uint
+	File          string
+	BatchSize     uint `yaml:"batchSize"`
+
+	// ExpectTree holds the assertions on the tree of an ExpandPermissionTree step.
+	ExpectTree *TreeExpectations `yaml:"expectTree"`
+
+	// PageSize and Paginate page through the results of a lookup or read.
+	PageSize uint `yaml:"pageSize"`
+	Paginate string
+
+	// Match is how results are compared to the expected ones: exact or subset.
+	Match string
+
+	// Capture names the results of the step for ${capture:name} placeholders.
+	Capture string
+
+	// Duration and Distribution are how long a Sleep step waits.
+	Duration     time.Duration
+	Distribution string
+
+	// ExpectError makes the step succeed only when its call fails as described.
+	ExpectError *ExpectedError `yaml:"expectError"`
+
+	// ContinueOnError keeps the steps after this one going when it fails.
+	ContinueOnError bool `yaml:"continueOnError"`
+
+	// Repeat, Choose, and If control which Steps, or Else steps, a step
+	// without an Op runs.
+	Repeat uint
+	Choose []Branch
+	If     *Condition
+	Steps  []ScriptStep
+	Else   []ScriptStep
+}
+
+// Relationship is a relationship read or loaded by a step.
+type Relationship struct {
+	Resource   string
+	Relation   string
+	Subject    string
+	Caveat     *CaveatContext
+	Expiration string
+}
+
+// TreeExpectations are assertions on the tree returned by ExpandPermissionTree.
+type TreeExpectations struct {
+	Includes []string
+	Excludes []string
+	MaxDepth uint `yaml:"maxDepth"`
+	Golden   string
+	Dump     bool
+}
+
+// ExpectedError is the gRPC status code and part of the message a step expects.
+type ExpectedError struct {
+	Code            string
+	MessageContains string `yaml:"messageContains"`
+}
+
+// Branch is one of the sets of steps a Choose step picks from.
+type Branch struct {
+	Weight uint
+	Steps  []ScriptStep
+}
+
+// Condition is the condition of an If step.
+type Condition struct {
+	Captured string
+	Previous string
+	Not      bool
 }
 
 // Check is one of a set of Checks handed to CheckBulk
@@ -0,0 +1,131 @@
+// Package control serves an HTTP API for changing a thumper run while it is
+// in progress.
+//
+// Every endpoint responds with the status of the run as JSON:
+//
+//	GET  /status   returns the status of the run
+//	PUT  /qps      sets the target rate, from a body like {"qps": 200}
+//	POST /pause    stops issuing requests
+//	POST /resume   continues issuing requests
+//	PUT  /weights  sets script weights, from a body like {"weights": {"script name": 3}}
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Target is the run being controlled.
+type Target interface {
+	Status() thumperrunner.ControlStatus
+	SetQPS(qps float64) error
+	Pause()
+	Resume()
+	SetWeights(weights map[string]uint) error
+}
+
+type statusResponse struct {
+	TargetQPS      float64         `json:"targetQPS"`
+	Paused         bool            `json:"paused"`
+	Dispatched     int64           `json:"dispatched"`
+	ElapsedSeconds float64         `json:"elapsedSeconds"`
+	Weights        map[string]uint `json:"weights"`
+}
+
+type qpsRequest struct {
+	QPS *float64 `json:"qps"`
+}
+
+type weightsRequest struct {
+	Weights map[string]uint `json:"weights"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// NewHandler creates a handler that serves the control API for the target.
+func NewHandler(target Target) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, _ *http.Request) {
+		writeStatus(w, target)
+	})
+
+	mux.HandleFunc("PUT /qps", func(w http.ResponseWriter, r *http.Request) {
+		var req qpsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		if req.QPS == nil {
+			writeError(w, errors.New("qps is required"))
+			return
+		}
+		if err := target.SetQPS(*req.QPS); err != nil {
+			writeError(w, err)
+			return
+		}
+		writeStatus(w, target)
+	})
+
+	mux.HandleFunc("POST /pause", func(w http.ResponseWriter, _ *http.Request) {
+		target.Pause()
+		writeStatus(w, target)
+	})
+
+	mux.HandleFunc("POST /resume", func(w http.ResponseWriter, _ *http.Request) {
+		target.Resume()
+		writeStatus(w, target)
+	})
+
+	mux.HandleFunc("PUT /weights", func(w http.ResponseWriter, r *http.Request) {
+		var req weightsRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, fmt.Errorf("invalid request body: %w", err))
+			return
+		}
+		if len(req.Weights) == 0 {
+			writeError(w, errors.New("weights are required"))
+			return
+		}
+		if err := target.SetWeights(req.Weights); err != nil {
+			writeError(w, err)
+			return
+		}
+
+		log.Info().Interface("weights", req.Weights).Msg("changed script weights")
+		writeStatus(w, target)
+	})
+
+	return mux
+}
+
+func writeStatus(w http.ResponseWriter, target Target) {
+	status := target.Status()
+	writeJSON(w, http.StatusOK, statusResponse{
+		TargetQPS:      status.TargetQPS,
+		Paused:         status.Paused,
+		Dispatched:     status.Dispatched,
+		ElapsedSeconds: status.Elapsed.Seconds(),
+		Weights:        status.Weights,
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	writeJSON(w, http.StatusBadRequest, errorResponse{Error: err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Warn().Err(err).Msg("unable to write control response")
+	}
+}
@@ -0,0 +1,162 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTarget struct {
+	status thumperrunner.ControlStatus
+}
+
+func (f *fakeTarget) Status() thumperrunner.ControlStatus {
+	return f.status
+}
+
+func (f *fakeTarget) SetQPS(qps float64) error {
+	if qps <= 0 {
+		return errors.New("qps must be positive")
+	}
+	f.status.TargetQPS = qps
+	return nil
+}
+
+func (f *fakeTarget) Pause() {
+	f.status.Paused = true
+}
+
+func (f *fakeTarget) Resume() {
+	f.status.Paused = false
+}
+
+func (f *fakeTarget) SetWeights(weights map[string]uint) error {
+	for name, weight := range weights {
+		if _, ok := f.status.Weights[name]; !ok {
+			return errors.New("unknown script: " + name)
+		}
+		f.status.Weights[name] = weight
+	}
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name           string
+		method         string
+		path           string
+		body           string
+		expectedCode   int
+		expectedStatus statusResponse
+		expectedError  string
+	}{
+		{
+			name:         "status",
+			method:       http.MethodGet,
+			path:         "/status",
+			expectedCode: http.StatusOK,
+			expectedStatus: statusResponse{
+				TargetQPS: 10, Dispatched: 42, ElapsedSeconds: 5,
+				Weights: map[string]uint{"read": 3, "write": 1},
+			},
+		},
+		{
+			name:         "set qps",
+			method:       http.MethodPut,
+			path:         "/qps",
+			body:         `{"qps": 250}`,
+			expectedCode: http.StatusOK,
+			expectedStatus: statusResponse{
+				TargetQPS: 250, Dispatched: 42, ElapsedSeconds: 5,
+				Weights: map[string]uint{"read": 3, "write": 1},
+			},
+		},
+		{
+			name:          "missing qps",
+			method:        http.MethodPut,
+			path:          "/qps",
+			body:          `{}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "qps is required",
+		},
+		{
+			name:          "invalid qps",
+			method:        http.MethodPut,
+			path:          "/qps",
+			body:          `{"qps": -1}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "qps must be positive",
+		},
+		{
+			name:         "pause",
+			method:       http.MethodPost,
+			path:         "/pause",
+			expectedCode: http.StatusOK,
+			expectedStatus: statusResponse{
+				TargetQPS: 10, Paused: true, Dispatched: 42, ElapsedSeconds: 5,
+				Weights: map[string]uint{"read": 3, "write": 1},
+			},
+		},
+		{
+			name:         "set weights",
+			method:       http.MethodPut,
+			path:         "/weights",
+			body:         `{"weights": {"write": 5}}`,
+			expectedCode: http.StatusOK,
+			expectedStatus: statusResponse{
+				TargetQPS: 10, Dispatched: 42, ElapsedSeconds: 5,
+				Weights: map[string]uint{"read": 3, "write": 5},
+			},
+		},
+		{
+			name:          "unknown script",
+			method:        http.MethodPut,
+			path:          "/weights",
+			body:          `{"weights": {"delete": 5}}`,
+			expectedCode:  http.StatusBadRequest,
+			expectedError: "unknown script: delete",
+		},
+		{
+			name:         "wrong method",
+			method:       http.MethodPost,
+			path:         "/status",
+			expectedCode: http.StatusMethodNotAllowed,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := &fakeTarget{status: thumperrunner.ControlStatus{
+				SchedulerStatus: thumperrunner.SchedulerStatus{
+					TargetQPS:  10,
+					Dispatched: 42,
+					Elapsed:    5 * time.Second,
+				},
+				Weights: map[string]uint{"read": 3, "write": 1},
+			}}
+
+			recorder := httptest.NewRecorder()
+			NewHandler(target).ServeHTTP(recorder, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+			require.Equal(t, tt.expectedCode, recorder.Code)
+
+			switch {
+			case tt.expectedError != "":
+				var resp errorResponse
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+				require.Contains(t, resp.Error, tt.expectedError)
+			case tt.expectedCode == http.StatusOK:
+				var resp statusResponse
+				require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &resp))
+				require.Equal(t, tt.expectedStatus, resp)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+)
+
+// reportTimeout bounds how long an agent tries to deliver its results.
+const reportTimeout = 30 * time.Second
+
+// RunFunc runs an agent's share of a run, stopping early once stop is closed.
+type RunFunc func(start *StartCommand, stop <-chan struct{}) (thumperrunner.ResultsSnapshot, error)
+
+// AgentOptions represent the configuration for an agent.
+type AgentOptions struct {
+	Name   string
+	Weight float64
+}
+
+// RunAgent joins the coordinator on the given connection and runs whatever it
+// is told to, until the coordinator releases it or the context is cancelled.
+// A run that is in progress when the context is cancelled is stopped, and its
+// results are still reported.
+func RunAgent(ctx context.Context, conn *grpc.ClientConn, options AgentOptions, run RunFunc) error {
+	streamCtx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := conn.NewStream(
+		streamCtx,
+		&serviceDesc.Streams[0],
+		joinMethod,
+		grpc.CallContentSubtype(jsonCodec{}.Name()),
+		grpc.WaitForReady(true),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to join coordinator: %w", err)
+	}
+
+	if err := stream.SendMsg(&JoinRequest{Name: options.Name, Weight: options.Weight}); err != nil {
+		return fmt.Errorf("unable to join coordinator: %w", err)
+	}
+	if err := stream.CloseSend(); err != nil {
+		return fmt.Errorf("unable to join coordinator: %w", err)
+	}
+
+	log.Info().Str("agent", options.Name).Msg("joined coordinator")
+
+	commands := make(chan *Command)
+	streamErr := make(chan error, 1)
+	go func() {
+		defer close(commands)
+		for {
+			command := &Command{}
+			if err := stream.RecvMsg(command); err != nil {
+				if !errors.Is(err, io.EOF) {
+					streamErr <- err
+				}
+				return
+			}
+			commands <- command
+		}
+	}()
+
+	var stop chan struct{}
+	var finished chan struct{}
+	stopRun := func() {
+		if stop != nil {
+			close(stop)
+			stop = nil
+		}
+	}
+
+	done := ctx.Done()
+	for {
+		select {
+		case <-done:
+			// Let a run in progress finish and report before leaving.
+			stopRun()
+			done = nil
+			if finished == nil {
+				return nil
+			}
+		case <-finished:
+			finished = nil
+			stop = nil
+			if done == nil {
+				return nil
+			}
+		case command, ok := <-commands:
+			if !ok {
+				stopRun()
+				if finished != nil {
+					<-finished
+				}
+
+				select {
+				case err := <-streamErr:
+					return fmt.Errorf("lost connection to coordinator: %w", err)
+				default:
+					log.Info().Str("agent", options.Name).Msg("released by coordinator")
+					return nil
+				}
+			}
+
+			switch {
+			case command.Start != nil:
+				if finished != nil {
+					log.Warn().Str("agent", options.Name).Msg("ignoring start command while running")
+					continue
+				}
+
+				stop = make(chan struct{})
+				finished = make(chan struct{})
+				go runAndReport(conn, options.Name, command.Start, stop, finished, run)
+			case command.Stop != nil:
+				log.Info().Str("agent", options.Name).Msg("stopped by coordinator")
+				stopRun()
+			}
+		}
+	}
+}
+
+func runAndReport(conn *grpc.ClientConn, name string, start *StartCommand, stop <-chan struct{}, finished chan<- struct{}, run RunFunc) {
+	defer close(finished)
+
+	log.Info().Str("agent", name).Float64("qps", start.QPS).Msg("starting run")
+
+	report := &ReportRequest{Name: name}
+	results, err := run(start, stop)
+	report.Results = results
+	if err != nil {
+		log.Error().Err(err).Str("agent", name).Msg("run failed")
+		report.Error = err.Error()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reportTimeout)
+	defer cancel()
+
+	if err := conn.Invoke(ctx, reportMethod, report, &ReportResponse{}, grpc.CallContentSubtype(jsonCodec{}.Name())); err != nil {
+		log.Error().Err(err).Str("agent", name).Msg("unable to report results")
+		return
+	}
+
+	log.Info().Str("agent", name).Msg("reported results")
+}
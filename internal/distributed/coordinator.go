@@ -0,0 +1,322 @@
+package distributed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Plan describes a run that the coordinator distributes over its agents.
+type Plan struct {
+	Scripts    []config.ScriptFile
+	QPS        float64
+	Arrival    thumperrunner.ArrivalMode
+	Duration   time.Duration
+	Requests   int
+	StartDelay time.Duration
+
+	// ReportTimeout bounds how long the coordinator waits for agents to
+	// report once they have been told to stop.
+	ReportTimeout time.Duration
+
+	// Seed is the seed of the run, from which every agent is given a seed of
+	// its own.
+	Seed int64
+}
+
+// AgentResult is the outcome of a single agent's share of a run.
+type AgentResult struct {
+	Name  string
+	QPS   float64
+	Error string
+}
+
+// Coordinator accepts agents and distributes runs over them.
+type Coordinator struct {
+	mu      sync.Mutex
+	agents  map[string]*agent
+	changed chan struct{}
+	reports chan *ReportRequest
+}
+
+type agent struct {
+	name     string
+	weight   float64
+	commands chan *Command
+	gone     chan struct{}
+}
+
+// NewCoordinator creates a coordinator without any agents.
+func NewCoordinator() *Coordinator {
+	return &Coordinator{
+		agents:  make(map[string]*agent),
+		changed: make(chan struct{}, 1),
+		reports: make(chan *ReportRequest),
+	}
+}
+
+// Register adds the coordinator service to a gRPC server.
+func (c *Coordinator) Register(server *grpc.Server) {
+	server.RegisterService(&serviceDesc, c)
+}
+
+func (c *Coordinator) notify() {
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// Join holds the stream of commands to an agent open until the coordinator
+// is done with it or the agent disconnects.
+func (c *Coordinator) Join(req *JoinRequest, stream grpc.ServerStream) error {
+	if req.Name == "" {
+		return status.Error(codes.InvalidArgument, "agent name is required")
+	}
+
+	a := &agent{
+		name:     req.Name,
+		weight:   req.Weight,
+		commands: make(chan *Command, 1),
+		gone:     make(chan struct{}),
+	}
+	if a.weight <= 0 {
+		a.weight = 1
+	}
+
+	c.mu.Lock()
+	if _, ok := c.agents[a.name]; ok {
+		c.mu.Unlock()
+		return status.Errorf(codes.AlreadyExists, "agent %s has already joined", a.name)
+	}
+	c.agents[a.name] = a
+	c.mu.Unlock()
+	c.notify()
+
+	log.Info().Str("agent", a.name).Float64("weight", a.weight).Msg("agent joined")
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.agents, a.name)
+		c.mu.Unlock()
+		close(a.gone)
+		c.notify()
+		log.Info().Str("agent", a.name).Msg("agent left")
+	}()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case command, ok := <-a.commands:
+			if !ok {
+				return nil
+			}
+			if err := stream.SendMsg(command); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Report receives the results of an agent.
+func (c *Coordinator) Report(ctx context.Context, req *ReportRequest) (*ReportResponse, error) {
+	select {
+	case c.reports <- req:
+		return &ReportResponse{}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// WaitForAgents blocks until at least the given number of agents have joined.
+func (c *Coordinator) WaitForAgents(ctx context.Context, count int) error {
+	for {
+		c.mu.Lock()
+		joined := len(c.agents)
+		c.mu.Unlock()
+
+		if joined >= count {
+			return nil
+		}
+
+		log.Info().Int("joined", joined).Int("expected", count).Msg("waiting for agents")
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("only %d of %d agents joined: %w", joined, count, ctx.Err())
+		case <-c.changed:
+		}
+	}
+}
+
+// Run distributes the plan over all agents that have joined, in proportion to
+// their weights, and merges their results. When the context is cancelled, the
+// agents are told to stop early. Agents are released once the run is over.
+func (c *Coordinator) Run(ctx context.Context, plan Plan) (*thumperrunner.Results, []AgentResult, error) {
+	c.mu.Lock()
+	agents := make([]*agent, 0, len(c.agents))
+	var totalWeight float64
+	for _, a := range c.agents {
+		agents = append(agents, a)
+		totalWeight += a.weight
+	}
+	c.mu.Unlock()
+
+	if len(agents) == 0 {
+		return nil, nil, errors.New("no agents have joined")
+	}
+
+	sort.Slice(agents, func(i, j int) bool {
+		return agents[i].name < agents[j].name
+	})
+
+	defer func() {
+		for _, a := range agents {
+			close(a.commands)
+		}
+	}()
+
+	weights := make([]float64, 0, len(agents))
+	for _, a := range agents {
+		weights = append(weights, a.weight)
+	}
+	requests := splitRequests(plan.Requests, weights, totalWeight)
+
+	// An agent without requests would run without a limit, so it is left
+	// out of a run with a limit that is spread too thin to reach it, and the
+	// rate is split between the agents that do start.
+	idle := func(index int) bool {
+		return plan.Requests > 0 && requests[index] == 0
+	}
+	var startedWeight float64
+	for index, a := range agents {
+		if !idle(index) {
+			startedWeight += a.weight
+		}
+	}
+
+	shares := make(map[string]float64, len(agents))
+	pending := make(map[string]*agent, len(agents))
+	for index, a := range agents {
+		if idle(index) {
+			log.Info().Str("agent", a.name).Msg("leaving agent idle, it has no requests to issue")
+			continue
+		}
+
+		share := a.weight / startedWeight
+		shares[a.name] = plan.QPS * share
+
+		start := &StartCommand{
+			Scripts:    plan.Scripts,
+			QPS:        shares[a.name],
+			Share:      share,
+			Arrival:    string(plan.Arrival),
+			Duration:   plan.Duration,
+			Requests:   requests[index],
+			StartDelay: plan.StartDelay,
+			Seed:       thumperrunner.DeriveSeed(plan.Seed, "agent", index),
+		}
+
+		log.Info().Str("agent", a.name).Float64("qps", start.QPS).Msg("starting agent")
+		a.send(&Command{Start: start})
+		pending[a.name] = a
+	}
+
+	merged := thumperrunner.NewResults()
+	agentResults := make([]AgentResult, 0, len(agents))
+	var reportDeadline <-chan time.Time
+	done := ctx.Done()
+	for len(pending) > 0 {
+		select {
+		case <-done:
+			log.Info().Int("agents", len(pending)).Msg("stopping agents")
+			for _, a := range pending {
+				a.send(&Command{Stop: &StopCommand{}})
+			}
+			done = nil
+			reportDeadline = time.After(plan.ReportTimeout)
+		case <-reportDeadline:
+			return merged, agentResults, fmt.Errorf("%d agents did not report in time", len(pending))
+		case <-c.changed:
+			for name, a := range pending {
+				select {
+				case <-a.gone:
+					log.Warn().Str("agent", name).Msg("agent left before reporting")
+					agentResults = append(agentResults, AgentResult{Name: name, Error: "agent left before reporting"})
+					delete(pending, name)
+				default:
+				}
+			}
+		case report := <-c.reports:
+			if _, ok := pending[report.Name]; !ok {
+				log.Warn().Str("agent", report.Name).Msg("ignoring unexpected report")
+				continue
+			}
+
+			log.Info().Str("agent", report.Name).Msg("agent reported")
+			merged.Merge(report.Results)
+			agentResults = append(agentResults, AgentResult{
+				Name:  report.Name,
+				QPS:   shares[report.Name],
+				Error: report.Error,
+			})
+			delete(pending, report.Name)
+		}
+	}
+
+	return merged, agentResults, nil
+}
+
+// send queues a command for the agent, unless it has already left.
+func (a *agent) send(command *Command) {
+	select {
+	case a.commands <- command:
+	case <-a.gone:
+	}
+}
+
+// splitRequests divides the requests over agents with the given weights in
+// proportion to them, handing out the rounding remainder one request at a
+// time to the agents with the largest fractions left over, so that the agents
+// issue exactly the requested number of requests.
+func splitRequests(total int, weights []float64, totalWeight float64) []int {
+	split := make([]int, len(weights))
+	if total <= 0 {
+		return split
+	}
+
+	fractions := make([]float64, len(weights))
+	assigned := 0
+	for index, weight := range weights {
+		exact := float64(total) * weight / totalWeight
+		split[index] = int(math.Floor(exact))
+		fractions[index] = exact - math.Floor(exact)
+		assigned += split[index]
+	}
+
+	order := make([]int, len(weights))
+	for index := range order {
+		order[index] = index
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return fractions[order[i]] > fractions[order[j]]
+	})
+	for i := 0; assigned < total; i++ {
+		split[order[i%len(order)]]++
+		assigned++
+	}
+	return split
+}
@@ -0,0 +1,207 @@
+package distributed
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func startCoordinator(t *testing.T) (*Coordinator, string) {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	coordinator := NewCoordinator()
+	coordinator.Register(server)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	return coordinator, lis.Addr().String()
+}
+
+func startAgents(t *testing.T, addr string, weights []float64, run RunFunc) *sync.WaitGroup {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	for index, weight := range weights {
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := RunAgent(context.Background(), conn, AgentOptions{
+				Name:   fmt.Sprintf("agent-%d", index),
+				Weight: weight,
+			}, run)
+			assert.NoError(t, err)
+		}()
+	}
+	return &wg
+}
+
+func fakeResults(count uint64) thumperrunner.ResultsSnapshot {
+	latency := thumperrunner.HistogramSnapshot{
+		Counts:  []uint64{0, 0, count},
+		Total:   count,
+		Sum:     time.Duration(count) * 2 * time.Microsecond,
+		Lowest:  2 * time.Microsecond,
+		Highest: 2 * time.Microsecond,
+	}
+	return thumperrunner.ResultsSnapshot{Ops: map[string]thumperrunner.OpSnapshot{
+		"CheckPermission": {Errors: 1, Service: latency, Response: latency},
+	}}
+}
+
+func TestCoordinatorDistributesRun(t *testing.T) {
+	coordinator, addr := startCoordinator(t)
+
+	var mu sync.Mutex
+	starts := make([]*StartCommand, 0, 3)
+	agents := startAgents(t, addr, []float64{1, 1, 2}, func(start *StartCommand, _ <-chan struct{}) (thumperrunner.ResultsSnapshot, error) {
+		mu.Lock()
+		starts = append(starts, start)
+		mu.Unlock()
+		return fakeResults(10), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, coordinator.WaitForAgents(ctx, 3))
+
+	results, agentResults, err := coordinator.Run(ctx, Plan{
+		Scripts:  []config.ScriptFile{{Name: "script.yaml", Contents: "name: test"}},
+		QPS:      100,
+		Arrival:  thumperrunner.ArrivalPoisson,
+		Requests: 1001,
+	})
+	require.NoError(t, err)
+	require.Len(t, agentResults, 3)
+
+	// Agents are released once the run is over.
+	agents.Wait()
+
+	var qps, share float64
+	var requests int
+	for _, start := range starts {
+		require.Equal(t, "name: test", start.Scripts[0].Contents)
+		require.Equal(t, string(thumperrunner.ArrivalPoisson), start.Arrival)
+		qps += start.QPS
+		share += start.Share
+		requests += start.Requests
+	}
+	require.InDelta(t, 100, qps, .001)
+	require.InDelta(t, 1, share, .001)
+	require.Equal(t, 1001, requests)
+
+	summaries := results.Summary()
+	total := summaries[len(summaries)-1]
+	require.Equal(t, uint64(30), total.Count)
+	require.Equal(t, uint64(3), total.Errors)
+}
+
+func TestCoordinatorSpreadsFewRequests(t *testing.T) {
+	coordinator, addr := startCoordinator(t)
+
+	var mu sync.Mutex
+	var starts []*StartCommand
+	agents := startAgents(t, addr, []float64{1, 1, 1, 1, 3}, func(start *StartCommand, _ <-chan struct{}) (thumperrunner.ResultsSnapshot, error) {
+		mu.Lock()
+		starts = append(starts, start)
+		mu.Unlock()
+		return fakeResults(uint64(start.Requests)), nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, coordinator.WaitForAgents(ctx, 5))
+
+	_, agentResults, err := coordinator.Run(ctx, Plan{QPS: 10, Requests: 3})
+	require.NoError(t, err)
+	agents.Wait()
+
+	// Agents whose share rounds down to no requests are left idle, rather
+	// than started without a limit.
+	require.Len(t, agentResults, len(starts))
+	var requests int
+	var qps, share float64
+	for _, start := range starts {
+		require.Positive(t, start.Requests)
+		requests += start.Requests
+		qps += start.QPS
+		share += start.Share
+	}
+	require.Equal(t, 3, requests)
+
+	// The agents that start make up the whole rate between them.
+	require.InDelta(t, 10, qps, 1e-9)
+	require.InDelta(t, 1, share, 1e-9)
+}
+
+func TestSplitRequests(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    int
+		weights  []float64
+		expected []int
+	}{
+		{"no limit", 0, []float64{1, 2}, []int{0, 0}},
+		{"even", 9, []float64{1, 1, 1}, []int{3, 3, 3}},
+		{"remainder to the largest fractions", 10, []float64{1, 1, 1}, []int{4, 3, 3}},
+		{"fewer requests than agents", 2, []float64{1, 1, 1, 1}, []int{1, 1, 0, 0}},
+		{"uneven weights", 3, []float64{1, 1, 1, 1, 3}, []int{1, 1, 0, 0, 1}},
+		{"weights outweigh order", 1, []float64{1, 3}, []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var totalWeight float64
+			for _, weight := range tt.weights {
+				totalWeight += weight
+			}
+			require.Equal(t, tt.expected, splitRequests(tt.total, tt.weights, totalWeight))
+		})
+	}
+}
+
+func TestCoordinatorStopsAgents(t *testing.T) {
+	coordinator, addr := startCoordinator(t)
+
+	agents := startAgents(t, addr, []float64{1, 1}, func(_ *StartCommand, stop <-chan struct{}) (thumperrunner.ResultsSnapshot, error) {
+		<-stop
+		return fakeResults(5), nil
+	})
+
+	waitCtx, cancelWait := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancelWait()
+	require.NoError(t, coordinator.WaitForAgents(waitCtx, 2))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	results, agentResults, err := coordinator.Run(ctx, Plan{
+		QPS:           10,
+		ReportTimeout: 10 * time.Second,
+	})
+	require.NoError(t, err)
+	require.Len(t, agentResults, 2)
+	agents.Wait()
+
+	summaries := results.Summary()
+	require.Equal(t, uint64(10), summaries[len(summaries)-1].Count)
+}
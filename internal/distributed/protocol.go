@@ -0,0 +1,134 @@
+// Package distributed implements the protocol between a thumper coordinator
+// and the agents that generate load on its behalf.
+//
+// The protocol is plain gRPC, with messages encoded as JSON rather than
+// protobuf so that it does not need generated code. Agents connect to the
+// coordinator, which streams commands back to them.
+package distributed
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+	"github.com/authzed/internal/thumper/internal/thumperrunner"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+const (
+	serviceName  = "thumper.distributed.v1.Coordinator"
+	joinMethod   = "/" + serviceName + "/Join"
+	reportMethod = "/" + serviceName + "/Report"
+)
+
+// JoinRequest is sent by an agent when it connects to the coordinator.
+type JoinRequest struct {
+	Name string
+
+	// Weight is the share of the total rate the agent takes on, relative to
+	// the weights of the other agents.
+	Weight float64
+}
+
+// Command is streamed from the coordinator to an agent. Exactly one of its
+// fields is set.
+type Command struct {
+	Start *StartCommand
+	Stop  *StopCommand
+}
+
+// StartCommand assigns an agent its share of a run.
+type StartCommand struct {
+	Scripts []config.ScriptFile
+	QPS     float64
+	Arrival string
+
+	// Share is the fraction of the run the agent is responsible for, which
+	// scales the rates of scripts with a rate of their own.
+	Share float64
+
+	Duration time.Duration
+	Requests int
+
+	// StartDelay is how long the agent waits before issuing requests, which
+	// gives every agent time to prepare its scripts and start at the same
+	// time as the others.
+	StartDelay time.Duration
+
+	// Seed drives every random choice the agent makes. Agents are given
+	// different seeds derived from the seed of the run, in the order of their
+	// names.
+	Seed int64
+}
+
+// StopCommand makes an agent stop issuing requests and report its results.
+type StopCommand struct{}
+
+// ReportRequest carries the results of an agent's share of a run.
+type ReportRequest struct {
+	Name    string
+	Results thumperrunner.ResultsSnapshot
+	Error   string
+}
+
+// ReportResponse acknowledges a report.
+type ReportResponse struct{}
+
+// coordinatorServer is implemented by the Coordinator.
+type coordinatorServer interface {
+	Join(*JoinRequest, grpc.ServerStream) error
+	Report(context.Context, *ReportRequest) (*ReportResponse, error)
+}
+
+var serviceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*coordinatorServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Report",
+			Handler: func(srv any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				req := &ReportRequest{}
+				if err := dec(req); err != nil {
+					return nil, err
+				}
+				return srv.(coordinatorServer).Report(ctx, req)
+			},
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Join",
+			ServerStreams: true,
+			Handler: func(srv any, stream grpc.ServerStream) error {
+				req := &JoinRequest{}
+				if err := stream.RecvMsg(req); err != nil {
+					return err
+				}
+				return srv.(coordinatorServer).Join(req, stream)
+			},
+		},
+	},
+}
+
+// jsonCodec encodes messages as JSON. It is selected by the "json" content
+// subtype, which every call made by an agent requests.
+type jsonCodec struct{}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func init() {
+	encoding.RegisterCodec(jsonCodec{})
+}
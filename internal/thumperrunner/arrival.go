@@ -0,0 +1,45 @@
+package thumperrunner
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// ArrivalMode determines how the scheduler spaces requests over time.
+type ArrivalMode string
+
+const (
+	// ArrivalFixed issues requests at a constant interval of 1/qps.
+	ArrivalFixed ArrivalMode = "fixed"
+
+	// ArrivalUniform draws each inter-arrival time uniformly from [0, 2/qps).
+	ArrivalUniform ArrivalMode = "uniform"
+
+	// ArrivalPoisson draws exponentially distributed inter-arrival times with
+	// a mean of 1/qps, which makes the arrivals a Poisson process.
+	ArrivalPoisson ArrivalMode = "poisson"
+)
+
+// ParseArrivalMode converts a flag value into an ArrivalMode.
+func ParseArrivalMode(mode string) (ArrivalMode, error) {
+	switch ArrivalMode(mode) {
+	case ArrivalFixed, ArrivalUniform, ArrivalPoisson:
+		return ArrivalMode(mode), nil
+	default:
+		return "", fmt.Errorf("unknown arrival mode: %s", mode)
+	}
+}
+
+// draw returns how many units of work at the target rate must elapse before
+// the next request is issued. One unit corresponds to 1/qps seconds, so the
+// same draw works for constant rates as well as rates that change over time.
+func (m ArrivalMode) draw(rng *rand.Rand) float64 {
+	switch m {
+	case ArrivalUniform:
+		return rng.Float64() * 2
+	case ArrivalPoisson:
+		return rng.ExpFloat64()
+	default:
+		return 1
+	}
+}
@@ -0,0 +1,58 @@
+package thumperrunner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestArrivalDraw(t *testing.T) {
+	const qps = 50
+	const samples = 100000
+	mean := time.Second / qps
+
+	tests := []struct {
+		mode ArrivalMode
+		max  time.Duration
+	}{
+		{ArrivalFixed, mean},
+		{ArrivalUniform, 2 * mean},
+		{ArrivalPoisson, 0},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.mode), func(t *testing.T) {
+			rng := NewRand(1)
+
+			var total, shortest, longest time.Duration
+			shortest = time.Hour
+			for range samples {
+				l := &lane{remaining: tt.mode.draw(rng)}
+				interval := l.untilArrival(qps)
+				total += interval
+				shortest, longest = min(shortest, interval), max(longest, interval)
+			}
+
+			require.GreaterOrEqual(t, shortest, time.Duration(0))
+			if tt.max > 0 {
+				require.LessOrEqual(t, longest, tt.max)
+			}
+			if tt.mode == ArrivalFixed {
+				require.Equal(t, mean, shortest)
+				require.Equal(t, mean, longest)
+			}
+			require.InEpsilon(t, mean.Seconds(), (total / samples).Seconds(), 0.02)
+		})
+	}
+}
+
+func TestParseArrivalMode(t *testing.T) {
+	for _, mode := range []string{"fixed", "uniform", "poisson"} {
+		parsed, err := ParseArrivalMode(mode)
+		require.NoError(t, err)
+		require.Equal(t, ArrivalMode(mode), parsed)
+	}
+
+	_, err := ParseArrivalMode("bursty")
+	require.EqualError(t, err, "unknown arrival mode: bursty")
+}
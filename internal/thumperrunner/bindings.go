@@ -0,0 +1,258 @@
+package thumperrunner
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// placeholderPattern matches the runtime placeholders of a script, such as
+// ${rand:tenant} or ${capture:docs.subject}, which are resolved during an
+// iteration of the script rather than when the script is loaded.
+var placeholderPattern = regexp.MustCompile(`\$\{(\w+):([\w-]+)(?:\.(\w+))?\}`)
+
+// randomIDLength is the length of the object IDs drawn for ${rand:...}
+// placeholders, which matches the IDs drawn by randomObjectID.
+const randomIDLength = 64
+
+// bindings are the values of the placeholders during a single iteration of a
+// script. They are drawn the first time they are used, and shared by every
+// step of the iteration. Each value is drawn from a generator derived from
+// seed and its name, so that it does not depend on the order in which
+// concurrent steps use the placeholders.
+type bindings struct {
+	seed int64
+
+	// mu guards the values, since the steps of an iteration may run
+	// concurrently.
+	mu       sync.Mutex
+	random   map[string]string
+	captured map[string]*capture
+}
+
+// capture holds the results captured by a step. Each result is a set of
+// fields, of which the one with an empty name is used when a placeholder
+// names no field.
+type capture struct {
+	results []map[string]string
+
+	// picked is the result that placeholders resolve to, which is chosen
+	// the first time one is used.
+	picked map[string]string
+}
+
+func newBindings(rng *rand.Rand) *bindings {
+	return &bindings{
+		seed:     rng.Int63(),
+		random:   make(map[string]string),
+		captured: make(map[string]*capture),
+	}
+}
+
+// capture stores the results of a step under the given name, replacing any
+// results captured under it before.
+func (b *bindings) capture(name string, results []map[string]string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.captured[name] = &capture{results: results}
+}
+
+// hasCaptured returns whether any results have been captured under the given
+// name.
+func (b *bindings) hasCaptured(name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	captured, ok := b.captured[name]
+	return ok && len(captured.results) > 0
+}
+
+// expand replaces the placeholders in the given string with their values. It
+// returns an error if a captured value is used that was not captured.
+func (b *bindings) expand(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var err error
+	expanded := placeholderPattern.ReplaceAllStringFunc(s, func(placeholder string) string {
+		match := placeholderPattern.FindStringSubmatch(placeholder)
+		kind, name, field := match[1], match[2], match[3]
+
+		if kind == "capture" {
+			value, captureErr := b.capturedLocked(name, field)
+			if captureErr != nil && err == nil {
+				err = captureErr
+			}
+			return value
+		}
+
+		value, ok := b.random[name]
+		if !ok {
+			value = config.RandomObjectID(b.rand("rand:"+name), randomIDLength)
+			b.random[name] = value
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// describe replaces the placeholders in the given string with their values
+// where it can, for use in error messages.
+func (b *bindings) describe(s string) string {
+	expanded, _ := b.expand(s)
+	return expanded
+}
+
+// capturedLocked returns a field of one of the results captured under the
+// given name, picking one of them at random the first time.
+func (b *bindings) capturedLocked(name, field string) (string, error) {
+	captured, ok := b.captured[name]
+	switch {
+	case !ok:
+		return "", fmt.Errorf("nothing has been captured as %s", name)
+	case len(captured.results) == 0:
+		return "", fmt.Errorf("no results were captured as %s", name)
+	}
+
+	if captured.picked == nil {
+		captured.picked = captured.results[b.rand("capture:"+name).Intn(len(captured.results))]
+	}
+
+	value, ok := captured.picked[field]
+	if !ok {
+		return "", fmt.Errorf("results captured as %s have no field %s", name, field)
+	}
+	return value, nil
+}
+
+// rand returns the generator of the value with the given name.
+func (b *bindings) rand(name string) *rand.Rand {
+	return rand.New(rand.NewSource(DeriveSeed(b.seed, name, 0)))
+}
+
+// clonableRequest is a request message that can be copied without reflection.
+type clonableRequest[T any] interface {
+	proto.Message
+	CloneVT() T
+}
+
+// prepareRequest returns a function that returns a copy of the request for a
+// single call, with its placeholders replaced by the values of the iteration.
+// Steps may run concurrently, so each call gets a copy of the request.
+func prepareRequest[T clonableRequest[T]](req T) (func(*bindings) (T, error), error) {
+	var placeholders bool
+	var err error
+	rewriteStrings(req.ProtoReflect(), func(s string) string {
+		for _, match := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+			placeholders = true
+			if err == nil {
+				err = validatePlaceholder(match)
+			}
+		}
+		return s
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func(b *bindings) (T, error) {
+		call := req.CloneVT()
+		if !placeholders {
+			return call, nil
+		}
+
+		var err error
+		rewriteStrings(call.ProtoReflect(), func(s string) string {
+			expanded, expandErr := b.expand(s)
+			if expandErr != nil && err == nil {
+				err = expandErr
+			}
+			return expanded
+		})
+		return call, err
+	}, nil
+}
+
+// validatePlaceholder checks a match of placeholderPattern.
+func validatePlaceholder(match []string) error {
+	switch kind, field := match[1], match[3]; {
+	case kind == "capture":
+		return nil
+	case kind == "rand" && field == "":
+		return nil
+	default:
+		return fmt.Errorf("unknown placeholder %s", match[0])
+	}
+}
+
+// capturedNames returns the names of the captures the placeholders in the
+// given string refer to.
+func capturedNames(s string) []string {
+	var names []string
+	for _, match := range placeholderPattern.FindAllStringSubmatch(s, -1) {
+		if match[1] == "capture" {
+			names = append(names, match[2])
+		}
+	}
+	return names
+}
+
+// rewriteStrings replaces every string in the message that may contain a
+// placeholder, including those of nested messages, with the result of the
+// given function.
+func rewriteStrings(m protoreflect.Message, rewrite func(string) string) {
+	type update struct {
+		field protoreflect.FieldDescriptor
+		value string
+	}
+	var updates []update
+
+	m.Range(func(field protoreflect.FieldDescriptor, value protoreflect.Value) bool {
+		switch {
+		case field.IsList():
+			list := value.List()
+			for i := 0; i < list.Len(); i++ {
+				switch {
+				case field.Message() != nil:
+					rewriteStrings(list.Get(i).Message(), rewrite)
+				case field.Kind() == protoreflect.StringKind:
+					if s := list.Get(i).String(); strings.Contains(s, "${") {
+						list.Set(i, protoreflect.ValueOfString(rewrite(s)))
+					}
+				}
+			}
+		case field.IsMap():
+			if field.MapValue().Message() != nil {
+				value.Map().Range(func(_ protoreflect.MapKey, entry protoreflect.Value) bool {
+					rewriteStrings(entry.Message(), rewrite)
+					return true
+				})
+			}
+		case field.Message() != nil:
+			rewriteStrings(value.Message(), rewrite)
+		case field.Kind() == protoreflect.StringKind:
+			if s := value.String(); strings.Contains(s, "${") {
+				updates = append(updates, update{field, rewrite(s)})
+			}
+		}
+		return true
+	})
+
+	// Fields are only set once the range is over, since setting them while
+	// ranging over them is not allowed.
+	for _, u := range updates {
+		m.Set(u.field, protoreflect.ValueOfString(u.value))
+	}
+}
@@ -0,0 +1,189 @@
+package thumperrunner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+func TestBindingsExpand(t *testing.T) {
+	b := newBindings(NewRand(1))
+
+	tenant := b.describe("${rand:tenant}")
+	require.Len(t, tenant, randomIDLength)
+	require.Equal(t, "tenant:"+tenant, b.describe("tenant:${rand:tenant}"))
+	require.NotEqual(t, tenant, b.describe("${rand:org}"))
+	require.Equal(t, "user:tom", b.describe("user:tom"))
+
+	require.NotEqual(t, tenant, newBindings(NewRand(2)).describe("${rand:tenant}"))
+}
+
+func TestPrepareRequest(t *testing.T) {
+	caveatContext, err := structpb.NewStruct(map[string]any{"owner": "${rand:user}"})
+	require.NoError(t, err)
+
+	req := &v1.WriteRelationshipsRequest{
+		Updates: []*v1.RelationshipUpdate{{
+			Operation: v1.RelationshipUpdate_OPERATION_TOUCH,
+			Relationship: &v1.Relationship{
+				Resource: &v1.ObjectReference{ObjectType: "document", ObjectId: "doc_${rand:doc}"},
+				Relation: "viewer",
+				Subject: &v1.SubjectReference{
+					Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "${rand:user}"},
+				},
+				OptionalCaveat: &v1.ContextualizedCaveat{CaveatName: "owned", Context: caveatContext},
+			},
+		}},
+	}
+	request, err := prepareRequest(req)
+	require.NoError(t, err)
+
+	b := newBindings(NewRand(1))
+	call, err := request(b)
+	require.NoError(t, err)
+	relationship := call.Updates[0].Relationship
+	require.Equal(t, b.describe("doc_${rand:doc}"), relationship.Resource.ObjectId)
+	require.Equal(t, b.describe("${rand:user}"), relationship.Subject.Object.ObjectId)
+	require.Equal(t, b.describe("${rand:user}"), relationship.OptionalCaveat.Context.Fields["owner"].GetStringValue())
+	require.Equal(t, "viewer", relationship.Relation)
+
+	// The prepared request itself is left untouched.
+	require.Equal(t, "doc_${rand:doc}", req.Updates[0].Relationship.Resource.ObjectId)
+	other, err := request(newBindings(NewRand(2)))
+	require.NoError(t, err)
+	require.NotEqual(t, relationship.Resource.ObjectId, other.Updates[0].Relationship.Resource.ObjectId)
+
+	_, err = prepareRequest(&v1.CheckPermissionRequest{Permission: "${env:permission}"})
+	require.EqualError(t, err, "unknown placeholder ${env:permission}")
+
+	_, err = prepareRequest(&v1.CheckPermissionRequest{Permission: "${rand:permission.id}"})
+	require.EqualError(t, err, "unknown placeholder ${rand:permission.id}")
+}
+
+func TestBindingsCapture(t *testing.T) {
+	b := newBindings(NewRand(1))
+	b.capture("docs", []map[string]string{
+		{"": "doc1", "resource": "doc1", "subject": "tom"},
+		{"": "doc2", "resource": "doc2", "subject": "fred"},
+	})
+	b.capture("none", nil)
+
+	// Every placeholder of a capture resolves to the same result.
+	picked, err := b.expand("${capture:docs}#${capture:docs.subject}")
+	require.NoError(t, err)
+	require.Contains(t, []string{"doc1#tom", "doc2#fred"}, picked)
+
+	tests := []struct {
+		placeholder string
+		expectedErr string
+	}{
+		{"${capture:missing}", "nothing has been captured as missing"},
+		{"${capture:none}", "no results were captured as none"},
+		{"${capture:docs.relation}", "results captured as docs have no field relation"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.placeholder, func(t *testing.T) {
+			_, err := b.expand(tt.placeholder)
+			require.EqualError(t, err, tt.expectedErr)
+		})
+	}
+
+	// Capturing again replaces the results and the pick.
+	b.capture("docs", []map[string]string{{"": "doc3"}})
+	require.Equal(t, "doc3", b.describe("${capture:docs}"))
+}
+
+func TestPrepareCaptureReferences(t *testing.T) {
+	lookup := config.ScriptStep{Op: "LookupResources", Resource: "document", Permission: "view", Subject: "user:tom", Capture: "docs"}
+	check := config.ScriptStep{Op: "CheckPermission", Resource: "document:${capture:docs}", Permission: "edit", Subject: "user:tom"}
+
+	tests := []struct {
+		name        string
+		steps       []config.ScriptStep
+		expectedErr string
+	}{
+		{"captured before use", []config.ScriptStep{lookup, check}, ""},
+		{"used before captured", []config.ScriptStep{check, lookup}, "step 0 of script test uses capture docs before any step captures it"},
+		{"imported before captured", []config.ScriptStep{{Op: "ImportBulkRelationships", Relationships: []config.Relationship{{Resource: "document:${capture:docs}", Relation: "viewer", Subject: "user:tom"}}}, lookup}, "step 0 of script test uses capture docs before any step captures it"},
+		{"capture from a check", []config.ScriptStep{{Op: "CheckPermission", Resource: "document:a", Permission: "edit", Subject: "user:tom", Capture: "docs"}}, "CheckPermission steps cannot capture their results"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Prepare([]*config.Script{{Name: "test", Weight: 1, Steps: tt.steps}})
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestWorkerBindingsPerPass(t *testing.T) {
+	var resources []string
+	record := func(_ context.Context, _ *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+		resources = append(resources, b.describe("${rand:doc}"))
+		return zt, nil
+	}
+
+	worker, err := NewWorker(WorkerOptions{
+		Clients:     NewClientPool(&authzed.Client{}),
+		Scripts:     []*ExecutableScript{{name: "steps", weight: 1, steps: []executableStep{{body: record}, {body: record}}}},
+		StepTimeout: time.Second,
+		Rand:        NewRand(1),
+	})
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		require.True(t, worker.Step(context.Background(), time.Now()))
+	}
+
+	// Both steps of a pass share a value, which the next pass replaces.
+	require.Len(t, resources, 4)
+	require.Equal(t, resources[0], resources[1])
+	require.Equal(t, resources[2], resources[3])
+	require.NotEqual(t, resources[1], resources[2])
+	require.NotContains(t, resources[0], "${")
+}
+
+func TestSessionCapture(t *testing.T) {
+	permissions := &fakePermissions{
+		resources: []string{"doc1", "doc2"},
+		checked:   make(chan *v1.CheckPermissionRequest, 1),
+	}
+	client := startFakeServer(t, permissions)
+
+	scripts, err := Prepare([]*config.Script{{
+		Name:   "list then check",
+		Weight: 1,
+		Mode:   "session",
+		Steps: []config.ScriptStep{
+			{Op: "LookupResources", Resource: "document", Permission: "view", Subject: "user:tom", NumExpected: 2, Capture: "docs"},
+			{Op: "CheckPermission", Resource: "document:${capture:docs}", Permission: "edit", Subject: "user:tom"},
+		},
+	}})
+	require.NoError(t, err)
+
+	results := NewResults()
+	worker, err := NewWorker(WorkerOptions{
+		Clients:     NewClientPool(client),
+		Scripts:     scripts,
+		StepTimeout: time.Second,
+		Results:     results,
+	})
+	require.NoError(t, err)
+
+	require.True(t, worker.Step(context.Background(), time.Now()))
+	checked := <-permissions.checked
+	require.Contains(t, []string{"doc1", "doc2"}, checked.Resource.ObjectId)
+
+	summaries := results.Summary()
+	require.Zero(t, summaries[len(summaries)-1].Errors)
+}
@@ -0,0 +1,233 @@
+package thumperrunner
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// BreakerAction is what the circuit breaker does to a run when it trips.
+type BreakerAction string
+
+const (
+	// BreakerAbort stops the run for good.
+	BreakerAbort BreakerAction = "abort"
+
+	// BreakerPause pauses the run, and resumes it once the cooldown has
+	// passed to see whether the errors have cleared up.
+	BreakerPause BreakerAction = "pause"
+)
+
+// ParseBreakerAction returns the action with the given name.
+func ParseBreakerAction(name string) (BreakerAction, error) {
+	switch action := BreakerAction(name); action {
+	case BreakerAbort, BreakerPause:
+		return action, nil
+	default:
+		return "", fmt.Errorf("unknown circuit breaker action: %s", name)
+	}
+}
+
+// The states of the circuit breaker, as exposed in metrics.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+var breakerStateGauge = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "thumper",
+	Name:      "circuit_breaker_state",
+	Help:      "Whether the circuit breaker is in the given state, 1 for the current state and 0 for the others.",
+}, []string{"state"})
+
+// breakerCheckInterval is how often the circuit breaker looks at the error
+// rate.
+const breakerCheckInterval = time.Second
+
+// BreakerTarget is the run that a circuit breaker acts on.
+type BreakerTarget interface {
+	Pause()
+	Resume()
+	Stop()
+}
+
+// CircuitBreakerOptions represent the configuration for a circuit breaker.
+type CircuitBreakerOptions struct {
+	// MaxErrorRate is the fraction of failed steps over the window above
+	// which the breaker trips.
+	MaxErrorRate float64
+
+	// Window is the trailing period over which the error rate is measured,
+	// at a resolution of one second.
+	Window time.Duration
+
+	// MinRequests is the number of steps the window must hold before the
+	// error rate is trusted.
+	MinRequests int
+
+	Action BreakerAction
+
+	// Cooldown is how long a paused run waits before it is resumed on
+	// probation, in the half-open state.
+	Cooldown time.Duration
+}
+
+// CircuitBreaker watches the error rate of the steps of a run, and aborts or
+// pauses the run when the error rate stays too high.
+type CircuitBreaker struct {
+	options CircuitBreakerOptions
+
+	mu           sync.Mutex
+	buckets      []breakerBucket
+	state        string
+	stateChanged time.Time
+	tripped      error
+}
+
+// breakerBucket counts the steps that finished within a single second.
+type breakerBucket struct {
+	second   int64
+	requests int
+	failures int
+}
+
+// NewCircuitBreaker creates a closed circuit breaker from the given options.
+func NewCircuitBreaker(options CircuitBreakerOptions) (*CircuitBreaker, error) {
+	switch {
+	case options.MaxErrorRate <= 0 || options.MaxErrorRate >= 1:
+		return nil, errors.New("circuit breaker error rate must be between 0 and 1")
+	case options.Window < time.Second:
+		return nil, errors.New("circuit breaker window must be at least one second")
+	case options.MinRequests < 1:
+		return nil, errors.New("circuit breaker minimum requests must be at least 1")
+	case options.Action == BreakerPause && options.Cooldown <= 0:
+		return nil, errors.New("circuit breaker cooldown must be positive")
+	}
+
+	breaker := &CircuitBreaker{
+		options: options,
+		buckets: make([]breakerBucket, int(options.Window/time.Second)),
+	}
+	breaker.setState(breakerClosed, time.Now())
+	return breaker, nil
+}
+
+func (b *CircuitBreaker) record(failed bool) {
+	b.recordAt(time.Now(), failed)
+}
+
+func (b *CircuitBreaker) recordAt(now time.Time, failed bool) {
+	second := now.Unix()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = breakerBucket{second: second}
+	}
+	bucket.requests++
+	if failed {
+		bucket.failures++
+	}
+}
+
+// windowLocked sums the steps that finished within the window ending now.
+func (b *CircuitBreaker) windowLocked(now time.Time) (requests, failures int) {
+	second := now.Unix()
+	for _, bucket := range b.buckets {
+		if age := second - bucket.second; age >= 0 && age < int64(len(b.buckets)) {
+			requests += bucket.requests
+			failures += bucket.failures
+		}
+	}
+	return requests, failures
+}
+
+func (b *CircuitBreaker) setState(state string, now time.Time) {
+	b.state = state
+	b.stateChanged = now
+	for _, s := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		breakerStateGauge.WithLabelValues(s).Set(value)
+	}
+}
+
+// Watch checks the error rate every second and acts on the target, until
+// stop is closed or the breaker aborts the run.
+func (b *CircuitBreaker) Watch(target BreakerTarget, stop <-chan struct{}) {
+	ticker := time.NewTicker(breakerCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			if !b.check(target, now) {
+				return
+			}
+		}
+	}
+}
+
+// check moves the breaker between states, and returns false once the run
+// has been aborted.
+func (b *CircuitBreaker) check(target BreakerTarget, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	requests, failures := b.windowLocked(now)
+	exceeded := requests >= b.options.MinRequests &&
+		float64(failures)/float64(requests) > b.options.MaxErrorRate
+
+	switch b.state {
+	case breakerClosed, breakerHalfOpen:
+		if exceeded {
+			b.tripped = fmt.Errorf("circuit breaker tripped: %d of %d steps failed over %s, more than the allowed %.2f%%",
+				failures, requests, b.options.Window, b.options.MaxErrorRate*100)
+			log.Error().Err(b.tripped).Str("action", string(b.options.Action)).Msg("circuit breaker opened")
+			b.setState(breakerOpen, now)
+
+			if b.options.Action == BreakerAbort {
+				target.Stop()
+				return false
+			}
+			target.Pause()
+			return true
+		}
+
+		// A half-open breaker closes once a full window has passed without
+		// the error rate being exceeded.
+		if b.state == breakerHalfOpen && requests >= b.options.MinRequests && now.Sub(b.stateChanged) >= b.options.Window {
+			log.Info().Msg("circuit breaker closed")
+			b.tripped = nil
+			b.setState(breakerClosed, now)
+		}
+	case breakerOpen:
+		if now.Sub(b.stateChanged) >= b.options.Cooldown {
+			log.Info().Msg("circuit breaker half-open, resuming run")
+			clear(b.buckets)
+			b.setState(breakerHalfOpen, now)
+			target.Resume()
+		}
+	}
+	return true
+}
+
+// Tripped returns the reason the breaker opened, or nil if it never opened or
+// has closed again since.
+func (b *CircuitBreaker) Tripped() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tripped
+}
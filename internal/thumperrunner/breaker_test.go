@@ -0,0 +1,126 @@
+package thumperrunner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeBreakerTarget struct {
+	paused  bool
+	stopped bool
+}
+
+func (f *fakeBreakerTarget) Pause()  { f.paused = true }
+func (f *fakeBreakerTarget) Resume() { f.paused = false }
+func (f *fakeBreakerTarget) Stop()   { f.stopped = true }
+
+func recordSteps(breaker *CircuitBreaker, now time.Time, succeeded, failed int) {
+	for i := 0; i < succeeded; i++ {
+		breaker.recordAt(now, false)
+	}
+	for i := 0; i < failed; i++ {
+		breaker.recordAt(now, true)
+	}
+}
+
+func TestCircuitBreakerOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		options CircuitBreakerOptions
+	}{
+		{"zero error rate", CircuitBreakerOptions{Window: time.Second, MinRequests: 1, Action: BreakerAbort}},
+		{"error rate of one", CircuitBreakerOptions{MaxErrorRate: 1, Window: time.Second, MinRequests: 1, Action: BreakerAbort}},
+		{"short window", CircuitBreakerOptions{MaxErrorRate: .1, Window: time.Millisecond, MinRequests: 1, Action: BreakerAbort}},
+		{"no minimum", CircuitBreakerOptions{MaxErrorRate: .1, Window: time.Second, Action: BreakerAbort}},
+		{"pause without cooldown", CircuitBreakerOptions{MaxErrorRate: .1, Window: time.Second, MinRequests: 1, Action: BreakerPause}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewCircuitBreaker(tt.options)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestCircuitBreakerAbort(t *testing.T) {
+	breaker, err := NewCircuitBreaker(CircuitBreakerOptions{
+		MaxErrorRate: .5,
+		Window:       10 * time.Second,
+		MinRequests:  10,
+		Action:       BreakerAbort,
+	})
+	require.NoError(t, err)
+
+	target := &fakeBreakerTarget{}
+	now := time.Unix(1000, 0)
+
+	// Too few steps to judge.
+	recordSteps(breaker, now, 0, 9)
+	require.True(t, breaker.check(target, now))
+	require.NoError(t, breaker.Tripped())
+
+	// Failures that have left the window no longer count.
+	now = now.Add(10 * time.Second)
+	recordSteps(breaker, now, 10, 1)
+	require.True(t, breaker.check(target, now))
+	require.NoError(t, breaker.Tripped())
+
+	now = now.Add(5 * time.Second)
+	recordSteps(breaker, now, 0, 15)
+	require.False(t, breaker.check(target, now))
+	require.True(t, target.stopped)
+	require.ErrorContains(t, breaker.Tripped(), "16 of 26 steps failed")
+}
+
+func TestCircuitBreakerPause(t *testing.T) {
+	breaker, err := NewCircuitBreaker(CircuitBreakerOptions{
+		MaxErrorRate: .1,
+		Window:       5 * time.Second,
+		MinRequests:  5,
+		Action:       BreakerPause,
+		Cooldown:     30 * time.Second,
+	})
+	require.NoError(t, err)
+
+	target := &fakeBreakerTarget{}
+	now := time.Unix(1000, 0)
+
+	recordSteps(breaker, now, 5, 5)
+	require.True(t, breaker.check(target, now))
+	require.True(t, target.paused)
+	require.Equal(t, breakerOpen, breaker.state)
+	require.Error(t, breaker.Tripped())
+
+	// Still cooling down.
+	now = now.Add(10 * time.Second)
+	require.True(t, breaker.check(target, now))
+	require.True(t, target.paused)
+
+	// Resumed on probation, with the earlier failures forgotten.
+	now = now.Add(20 * time.Second)
+	require.True(t, breaker.check(target, now))
+	require.False(t, target.paused)
+	require.Equal(t, breakerHalfOpen, breaker.state)
+
+	// Failing again while half-open opens the breaker right away.
+	recordSteps(breaker, now, 4, 1)
+	require.True(t, breaker.check(target, now))
+	require.True(t, target.paused)
+	require.Equal(t, breakerOpen, breaker.state)
+
+	now = now.Add(30 * time.Second)
+	require.True(t, breaker.check(target, now))
+	require.Equal(t, breakerHalfOpen, breaker.state)
+
+	// A full window without too many failures closes it.
+	for i := 0; i < 5; i++ {
+		now = now.Add(time.Second)
+		recordSteps(breaker, now, 2, 0)
+		require.True(t, breaker.check(target, now))
+	}
+	require.Equal(t, breakerClosed, breaker.state)
+	require.NoError(t, breaker.Tripped())
+}
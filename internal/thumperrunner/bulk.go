@@ -0,0 +1,385 @@
+package thumperrunner
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/ccoveille/go-safecast"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var bulkRelationshipsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "thumper",
+	Name:      "bulk_relationships_total",
+	Help:      "Relationships sent by ImportBulkRelationships steps and received by ExportBulkRelationships steps.",
+}, []string{"op"})
+
+// defaultImportBatchSize is the number of relationships sent in each message
+// of an ImportBulkRelationships step that does not set its own.
+const defaultImportBatchSize = 1000
+
+// bulkStepTimeout bounds bulk steps, which stream far more than the single
+// requests the step timeout is meant for, as long as a whole migration.
+const bulkStepTimeout = 3600 * time.Second
+
+// indexPlaceholder is replaced in the object IDs of the relationships an
+// ImportBulkRelationships step generates by the number of the repetition.
+const indexPlaceholder = "${index}"
+
+// relationshipSource produces the relationships of an ImportBulkRelationships
+// step, one at a time, stopping at the first error returned by emit.
+type relationshipSource func(emit func(*v1.Relationship) error) error
+
+// prepareImport returns the body of an ImportBulkRelationships step. The
+// placeholders in its relationships are expanded once per call, before
+// ${index} is replaced in each repetition.
+func prepareImport(step config.ScriptStep) (func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error), error) {
+	var source func(*bindings) (relationshipSource, error)
+	switch {
+	case len(step.Relationships) > 0 && step.File != "":
+		return nil, errors.New("relationships cannot be combined with a file")
+	case len(step.Relationships) > 0:
+		templates := make([]*v1.Relationship, 0, len(step.Relationships))
+		for _, relationship := range step.Relationships {
+			template, err := parseRelationship(relationship)
+			if err != nil {
+				return nil, err
+			}
+			templates = append(templates, template)
+		}
+		request, err := prepareRequest(&v1.ImportBulkRelationshipsRequest{Relationships: templates})
+		if err != nil {
+			return nil, err
+		}
+		count := max(step.Count, 1)
+		source = func(b *bindings) (relationshipSource, error) {
+			expanded, err := request(b)
+			if err != nil {
+				return nil, err
+			}
+			return generateRelationships(expanded.Relationships, count), nil
+		}
+	case step.File != "":
+		if step.Count > 0 {
+			return nil, errors.New("count cannot be combined with a file")
+		}
+		// The file is only read when the step runs, since it may be too
+		// large to hold, but a missing one is reported right away.
+		path, err := config.FindFile(step.File)
+		if err != nil {
+			return nil, fmt.Errorf("error reading relationships file: %w", err)
+		}
+		source = func(*bindings) (relationshipSource, error) {
+			return readRelationships(path), nil
+		}
+	default:
+		return nil, errors.New("either relationships or a file is required")
+	}
+
+	batchSize := defaultImportBatchSize
+	if step.BatchSize > 0 {
+		var err error
+		if batchSize, err = safecast.Convert[int](step.BatchSize); err != nil {
+			return nil, fmt.Errorf("batchSize is too large: %w", err)
+		}
+	}
+
+	return func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+		relationships, err := source(b)
+		if err != nil {
+			return nil, err
+		}
+
+		// Cancelling the stream makes the server abandon the import if the
+		// relationships cannot all be sent.
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		start := time.Now()
+		stream, err := client.ImportBulkRelationships(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		batch := make([]*v1.Relationship, 0, batchSize)
+		send := func() error {
+			if len(batch) == 0 {
+				return nil
+			}
+			if err := stream.Send(&v1.ImportBulkRelationshipsRequest{Relationships: batch}); err != nil {
+				if errors.Is(err, io.EOF) {
+					// The server ended the stream, and the reason is
+					// only returned when it is closed.
+					_, err = stream.CloseAndRecv()
+				}
+				return err
+			}
+			bulkRelationshipsCounter.WithLabelValues("ImportBulkRelationships").Add(float64(len(batch)))
+			batch = batch[:0]
+			return nil
+		}
+
+		if err := relationships(func(relationship *v1.Relationship) error {
+			batch = append(batch, relationship)
+			if len(batch) < batchSize {
+				return nil
+			}
+			return send()
+		}); err != nil {
+			return nil, err
+		}
+		if err := send(); err != nil {
+			return nil, err
+		}
+
+		resp, err := stream.CloseAndRecv()
+		if err != nil {
+			return nil, err
+		}
+
+		reportThroughput("ImportBulkRelationships", resp.NumLoaded, time.Since(start))
+		return zt, nil
+	}, nil
+}
+
+// prepareExport returns the body of an ExportBulkRelationships step. Its file
+// is replaced as a whole once an export has been written to a temporary file
+// next to it, so that exports running at the same time cannot interleave.
+func prepareExport(step config.ScriptStep, consistencyForZedToken consistencyFunc) (func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error), error) {
+	var path string
+	if step.File != "" {
+		var err error
+		if path, err = filepath.Abs(step.File); err != nil {
+			return nil, fmt.Errorf("error resolving relationships file: %w", err)
+		}
+	}
+
+	limit, err := safecast.Convert[uint32](step.BatchSize)
+	if err != nil {
+		return nil, fmt.Errorf("batchSize is too large: %w", err)
+	}
+
+	req := &v1.ExportBulkRelationshipsRequest{OptionalLimit: limit}
+	if step.Resource != "" {
+		filter, err := parseRelationshipFilter(step.Resource, step.Permission, step.Subject)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing filter: %w", err)
+		}
+		req.OptionalRelationshipFilter = filter
+	}
+	request, err := prepareRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+		call, err := request(b)
+		if err != nil {
+			return nil, err
+		}
+		call.Consistency = consistencyForZedToken(zt)
+
+		start := time.Now()
+		stream, err := client.ExportBulkRelationships(ctx, call)
+		if err != nil {
+			return nil, err
+		}
+
+		var file *os.File
+		var out *bufio.Writer
+		if path != "" {
+			file, err = os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+			if err != nil {
+				return nil, fmt.Errorf("error creating relationships file: %w", err)
+			}
+			// Once the file has been renamed, removing it does nothing.
+			defer os.Remove(file.Name())
+			defer file.Close()
+			out = bufio.NewWriter(file)
+		}
+
+		var exported uint64
+		for {
+			resp, err := stream.Recv()
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("ExportBulkRelationships error: %w", err)
+			}
+
+			if out != nil {
+				for _, relationship := range resp.Relationships {
+					if _, err := fmt.Fprintln(out, describeRelationship(relationship)); err != nil {
+						return nil, fmt.Errorf("error writing relationships file: %w", err)
+					}
+				}
+			}
+			bulkRelationshipsCounter.WithLabelValues("ExportBulkRelationships").Add(float64(len(resp.Relationships)))
+			exported += uint64(len(resp.Relationships))
+		}
+
+		if out != nil {
+			if err := out.Flush(); err != nil {
+				return nil, fmt.Errorf("error writing relationships file: %w", err)
+			}
+			if err := file.Close(); err != nil {
+				return nil, fmt.Errorf("error writing relationships file: %w", err)
+			}
+			if err := os.Rename(file.Name(), path); err != nil {
+				return nil, fmt.Errorf("error writing relationships file: %w", err)
+			}
+		}
+
+		reportThroughput("ExportBulkRelationships", exported, time.Since(start))
+		return zt, nil
+	}, nil
+}
+
+// reportThroughput logs how many relationships a bulk step moved, and how
+// fast.
+func reportThroughput(op string, relationships uint64, elapsed time.Duration) {
+	log.Info().
+		Str("op", op).
+		Uint64("relationships", relationships).
+		Dur("duration", elapsed).
+		Float64("relationships-per-second", float64(relationships)/elapsed.Seconds()).
+		Msg("bulk step finished")
+}
+
+// generateRelationships returns a source of the templates repeated count
+// times, with the index placeholder in their object IDs replaced by the number
+// of the repetition, counting from zero.
+func generateRelationships(templates []*v1.Relationship, count uint) relationshipSource {
+	return func(emit func(*v1.Relationship) error) error {
+		for i := range count {
+			index := strconv.FormatUint(uint64(i), 10)
+			for _, template := range templates {
+				relationship := template.CloneVT()
+				relationship.Resource.ObjectId = strings.ReplaceAll(relationship.Resource.ObjectId, indexPlaceholder, index)
+				relationship.Subject.Object.ObjectId = strings.ReplaceAll(relationship.Subject.Object.ObjectId, indexPlaceholder, index)
+				if err := emit(relationship); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// readRelationships returns a source of the relationships in a file, one per
+// line in the form of describeRelationship. Empty lines, and lines starting
+// with //, are skipped.
+func readRelationships(path string) relationshipSource {
+	return func(emit func(*v1.Relationship) error) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("error reading relationships file: %w", err)
+		}
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+			if text == "" || strings.HasPrefix(text, "//") {
+				continue
+			}
+
+			relationship, err := parseDescribedRelationship(text)
+			if err != nil {
+				return fmt.Errorf("error parsing line %d of %s: %w", line, path, err)
+			}
+			if err := emit(relationship); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading relationships file: %w", err)
+		}
+		return nil
+	}
+}
+
+// parseDescribedRelationship parses a relationship in the form of
+// describeRelationship, such as
+// document:readme#viewer@user:tom[on_weekdays:{"day":"monday"}][expiration:2030-01-01T00:00:00Z].
+func parseDescribedRelationship(described string) (*v1.Relationship, error) {
+	tuple, attributes, hasAttributes := strings.Cut(described, "[")
+	resource, subject, ok := strings.Cut(tuple, "@")
+	if !ok {
+		return nil, fmt.Errorf("missing subject in %s", described)
+	}
+	object, relation, ok := strings.Cut(resource, "#")
+	if !ok || relation == "" {
+		return nil, fmt.Errorf("missing relation in %s", described)
+	}
+
+	resType, resID, _ := parseComponents(object)
+	subType, subID, subRel := parseComponents(subject)
+	if resType == "" || resID == "" || subType == "" || subID == "" {
+		return nil, fmt.Errorf("missing object type or ID in %s", described)
+	}
+
+	relationship := &v1.Relationship{
+		Resource: &v1.ObjectReference{ObjectType: resType, ObjectId: resID},
+		Relation: relation,
+		Subject: &v1.SubjectReference{
+			Object:           &v1.ObjectReference{ObjectType: subType, ObjectId: subID},
+			OptionalRelation: subRel,
+		},
+	}
+	if !hasAttributes {
+		return relationship, nil
+	}
+
+	// The expiration always comes last, after the caveat if there is one.
+	attributes = "[" + attributes
+	if i := strings.LastIndex(attributes, "[expiration:"); i >= 0 {
+		expiration, err := time.Parse(time.RFC3339, strings.TrimSuffix(attributes[i+len("[expiration:"):], "]"))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing expiration: %w", err)
+		}
+		relationship.OptionalExpiresAt = timestamppb.New(expiration)
+		attributes = attributes[:i]
+	}
+	if attributes == "" {
+		return relationship, nil
+	}
+
+	caveat, ok := strings.CutSuffix(strings.TrimPrefix(attributes, "["), "]")
+	if !ok {
+		return nil, fmt.Errorf("malformed caveat in %s", described)
+	}
+	name, encoded, hasContext := strings.Cut(caveat, ":")
+	relationship.OptionalCaveat = &v1.ContextualizedCaveat{CaveatName: name}
+	if hasContext {
+		var fields map[string]any
+		if err := json.Unmarshal([]byte(encoded), &fields); err != nil {
+			return nil, fmt.Errorf("error parsing caveat context: %w", err)
+		}
+		caveatContext, err := structpb.NewStruct(fields)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing caveat context: %w", err)
+		}
+		relationship.OptionalCaveat.Context = caveatContext
+	}
+	return relationship, nil
+}
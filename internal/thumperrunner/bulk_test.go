@@ -0,0 +1,234 @@
+package thumperrunner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDescribedRelationship(t *testing.T) {
+	tests := []struct {
+		described   string
+		expectedErr string
+	}{
+		{"document:readme#viewer@user:tom", ""},
+		{"document:readme#viewer@group:eng#member", ""},
+		{"document:readme#viewer@user:*", ""},
+		{`document:readme#viewer@user:tom[on_weekdays:{"day":"monday","hours":[9,17]}]`, ""},
+		{"document:readme#viewer@user:tom[on_weekdays]", ""},
+		{"document:readme#viewer@user:tom[expiration:2030-01-01T00:00:00Z]", ""},
+		{`document:readme#viewer@user:tom[on_weekdays:{"day":"monday"}][expiration:2030-01-01T00:00:00Z]`, ""},
+		{"document:readme#viewer", "missing subject in document:readme#viewer"},
+		{"document:readme@user:tom", "missing relation in document:readme@user:tom"},
+		{"document#viewer@user:tom", "missing object type or ID in document#viewer@user:tom"},
+		{"document:readme#viewer@user:tom[expiration:tomorrow]", `error parsing expiration: parsing time "tomorrow" as "2006-01-02T15:04:05Z07:00": cannot parse "tomorrow" as "2006"`},
+		{"document:readme#viewer@user:tom[on_weekdays:{]", "error parsing caveat context: unexpected end of JSON input"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.described, func(t *testing.T) {
+			relationship, err := parseDescribedRelationship(tt.described)
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.described, describeRelationship(relationship))
+		})
+	}
+}
+
+func TestImportBulkRelationships(t *testing.T) {
+	fixture := filepath.Join(t.TempDir(), "relationships.txt")
+	require.NoError(t, os.WriteFile(fixture, []byte(`// readme
+document:readme#viewer@user:tom
+
+document:readme#viewer@group:eng#member[on_weekdays]
+document:readme#viewer@user:fred
+`), 0o600))
+	t.Setenv("KO_DATA_PATH", filepath.Dir(fixture))
+
+	tests := []struct {
+		name     string
+		step     config.ScriptStep
+		expected [][]string
+	}{
+		{
+			"template",
+			config.ScriptStep{
+				Relationships: []config.Relationship{
+					{Resource: "tenant:t_${index}", Relation: "organization", Subject: "organization:org_${index}"},
+					{Resource: "tenant:t_${index}", Relation: "writer", Subject: "client:c_${index}#token"},
+				},
+				Count:     3,
+				BatchSize: 4,
+			},
+			[][]string{
+				{
+					"tenant:t_0#organization@organization:org_0",
+					"tenant:t_0#writer@client:c_0#token",
+					"tenant:t_1#organization@organization:org_1",
+					"tenant:t_1#writer@client:c_1#token",
+				},
+				{
+					"tenant:t_2#organization@organization:org_2",
+					"tenant:t_2#writer@client:c_2#token",
+				},
+			},
+		},
+		{
+			"placeholders",
+			config.ScriptStep{
+				Relationships: []config.Relationship{{Resource: "document:${capture:docs}", Relation: "viewer", Subject: "user:u_${index}"}},
+				Count:         2,
+			},
+			[][]string{{
+				"document:readme#viewer@user:u_0",
+				"document:readme#viewer@user:u_1",
+			}},
+		},
+		{
+			"file",
+			config.ScriptStep{File: fixture},
+			[][]string{{
+				"document:readme#viewer@user:tom",
+				"document:readme#viewer@group:eng#member[on_weekdays]",
+				"document:readme#viewer@user:fred",
+			}},
+		},
+		{
+			"file in kodata",
+			config.ScriptStep{File: filepath.Base(fixture)},
+			[][]string{{
+				"document:readme#viewer@user:tom",
+				"document:readme#viewer@group:eng#member[on_weekdays]",
+				"document:readme#viewer@user:fred",
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakePermissions{imported: make(chan []*v1.Relationship, len(tt.expected))}
+			client := startFakeServer(t, fake)
+
+			tt.step.Op = "ImportBulkRelationships"
+			step, err := prepareStep(tt.step)
+			require.NoError(t, err)
+
+			b := newBindings(NewRand(1))
+			b.capture("docs", []map[string]string{{"": "readme"}})
+			_, err = step.body(context.Background(), client, nil, b)
+			require.NoError(t, err)
+
+			close(fake.imported)
+			var batches [][]string
+			for batch := range fake.imported {
+				var described []string
+				for _, relationship := range batch {
+					described = append(described, describeRelationship(relationship))
+				}
+				batches = append(batches, described)
+			}
+			require.Equal(t, tt.expected, batches)
+		})
+	}
+}
+
+func TestBulkStepTimeout(t *testing.T) {
+	step, err := prepareStep(config.ScriptStep{
+		Op:            "ImportBulkRelationships",
+		Relationships: []config.Relationship{{Resource: "document:doc_${index}", Relation: "viewer", Subject: "user:tom"}},
+		Count:         10,
+	})
+	require.NoError(t, err)
+
+	fake := &fakePermissions{imported: make(chan []*v1.Relationship, 1)}
+	results := NewResults()
+	worker, err := NewWorker(WorkerOptions{
+		Clients:     NewClientPool(startFakeServer(t, fake)),
+		Scripts:     []*ExecutableScript{{name: "load", weight: 1, steps: []executableStep{step}}},
+		StepTimeout: time.Nanosecond,
+		Results:     results,
+	})
+	require.NoError(t, err)
+
+	// The step timeout of the worker, which no call could meet, does not
+	// apply to bulk steps.
+	require.True(t, worker.Step(context.Background(), time.Now()))
+	summaries := results.Summary()
+	require.Zero(t, summaries[len(summaries)-1].Errors)
+	require.Len(t, <-fake.imported, 10)
+}
+
+func TestExportBulkRelationships(t *testing.T) {
+	var relationships []*v1.Relationship
+	for _, described := range []string{
+		"document:readme#viewer@user:tom",
+		"document:readme#viewer@group:eng#member[on_weekdays]",
+		"document:readme#viewer@user:fred[expiration:2030-01-01T00:00:00Z]",
+	} {
+		relationship, err := parseDescribedRelationship(described)
+		require.NoError(t, err)
+		relationships = append(relationships, relationship)
+	}
+	client := startFakeServer(t, &fakePermissions{relationships: relationships})
+
+	dir := t.TempDir()
+	exported := filepath.Join(dir, "exported.txt")
+	step, err := prepareStep(config.ScriptStep{Op: "ExportBulkRelationships", Resource: "document", BatchSize: 2, File: exported})
+	require.NoError(t, err)
+
+	// Exports running at the same time each replace the whole file.
+	var wg sync.WaitGroup
+	for range 5 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := step.body(context.Background(), client, nil, newBindings(NewRand(1)))
+			require.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	contents, err := os.ReadFile(exported)
+	require.NoError(t, err)
+	require.Equal(t, `document:readme#viewer@user:tom
+document:readme#viewer@group:eng#member[on_weekdays]
+document:readme#viewer@user:fred[expiration:2030-01-01T00:00:00Z]
+`, string(contents))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+}
+
+func TestPrepareBulkRelationships(t *testing.T) {
+	template := []config.Relationship{{Resource: "document:doc_${index}", Relation: "viewer", Subject: "user:tom"}}
+
+	tests := []struct {
+		name        string
+		step        config.ScriptStep
+		expectedErr string
+	}{
+		{"nothing to import", config.ScriptStep{Op: "ImportBulkRelationships"}, "error preparing ImportBulkRelationships: either relationships or a file is required"},
+		{"relationships and file", config.ScriptStep{Op: "ImportBulkRelationships", Relationships: template, File: "relationships.txt"}, "error preparing ImportBulkRelationships: relationships cannot be combined with a file"},
+		{"count with file", config.ScriptStep{Op: "ImportBulkRelationships", File: "relationships.txt", Count: 2}, "error preparing ImportBulkRelationships: count cannot be combined with a file"},
+		{"missing file", config.ScriptStep{Op: "ImportBulkRelationships", File: filepath.Join(t.TempDir(), "missing.txt")}, "error preparing ImportBulkRelationships: error reading relationships file"},
+		{"unknown placeholder", config.ScriptStep{Op: "ImportBulkRelationships", Relationships: []config.Relationship{{Resource: "document:${rand:doc.id}", Relation: "viewer", Subject: "user:tom"}}}, "error preparing ImportBulkRelationships: unknown placeholder ${rand:doc.id}"},
+		{"export with relationships", config.ScriptStep{Op: "ExportBulkRelationships", Relationships: template}, "ExportBulkRelationships steps cannot load relationships"},
+		{"other op", config.ScriptStep{Op: "ReadRelationships", Resource: "document", BatchSize: 10}, "ReadRelationships steps cannot load or export relationships"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := prepareStep(tt.step)
+			require.ErrorContains(t, err, tt.expectedErr)
+		})
+	}
+}
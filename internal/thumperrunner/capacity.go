@@ -0,0 +1,89 @@
+package thumperrunner
+
+import (
+	"time"
+)
+
+// CapacityObjective is the latency and error objective a rate must meet to be
+// considered sustainable.
+type CapacityObjective struct {
+	MaxP99Latency time.Duration
+	MaxErrorRate  float64
+}
+
+// Met returns true if the summary of a step window meets the objective. The
+// latency is judged by response time, so that a rate at which requests queue
+// up does not pass.
+func (o CapacityObjective) Met(summary OpSummary) bool {
+	return summary.Count > 0 &&
+		summary.Response.P99 <= o.MaxP99Latency &&
+		summary.ErrorRate() <= o.MaxErrorRate
+}
+
+// CapacitySearchOptions represent the configuration for a capacity search.
+type CapacitySearchOptions struct {
+	StartQPS float64
+	MaxQPS   float64
+
+	// Growth is the factor by which the rate is increased while no rate
+	// has failed the objective yet.
+	Growth float64
+
+	// Precision is the relative distance between the highest passing and
+	// the lowest failing rate at which the search stops.
+	Precision float64
+}
+
+// CapacitySearch decides which rate to try next while looking for the highest
+// rate that meets an objective. It grows the rate geometrically until a rate
+// fails, and then bisects between the highest passing and the lowest failing
+// rate.
+type CapacitySearch struct {
+	options CapacitySearchOptions
+	next    float64
+	passed  float64
+	failed  float64
+}
+
+// NewCapacitySearch creates a search from the given options.
+func NewCapacitySearch(options CapacitySearchOptions) *CapacitySearch {
+	return &CapacitySearch{
+		options: options,
+		next:    min(options.StartQPS, options.MaxQPS),
+	}
+}
+
+// Next returns the rate to try next, or false once the search is done.
+func (c *CapacitySearch) Next() (float64, bool) {
+	return c.next, c.next > 0
+}
+
+// Report records whether the rate returned by Next met the objective.
+func (c *CapacitySearch) Report(passed bool) {
+	if passed {
+		c.passed = c.next
+	} else {
+		c.failed = c.next
+	}
+
+	switch {
+	case c.failed == 0 && c.passed >= c.options.MaxQPS:
+		// The objective holds up to the maximum rate we are allowed to try.
+		c.next = 0
+	case c.failed == 0:
+		c.next = min(c.passed*c.options.Growth, c.options.MaxQPS)
+	case c.passed == 0:
+		// Even the starting rate fails; there is no knee to find.
+		c.next = 0
+	case (c.failed-c.passed)/c.passed <= c.options.Precision:
+		c.next = 0
+	default:
+		c.next = (c.passed + c.failed) / 2
+	}
+}
+
+// Knee returns the highest rate found to meet the objective, or zero if none
+// did.
+func (c *CapacitySearch) Knee() float64 {
+	return c.passed
+}
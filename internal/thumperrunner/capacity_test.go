@@ -0,0 +1,49 @@
+package thumperrunner
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapacitySearch(t *testing.T) {
+	testCases := []struct {
+		threshold float64
+		expected  float64
+	}{
+		{730, 720},
+		{5, 0},
+		{1000000, 50000},
+		{10, 10},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			search := NewCapacitySearch(CapacitySearchOptions{
+				StartQPS:  10,
+				MaxQPS:    50000,
+				Growth:    2,
+				Precision: .05,
+			})
+
+			var tried int
+			for rate, ok := search.Next(); ok; rate, ok = search.Next() {
+				search.Report(rate <= tc.threshold)
+				tried++
+				require.Less(t, tried, 100, "search did not converge")
+			}
+
+			require.InDelta(t, tc.expected, search.Knee(), .001)
+		})
+	}
+}
+
+func TestCapacityObjective(t *testing.T) {
+	objective := CapacityObjective{MaxP99Latency: 100, MaxErrorRate: .01}
+
+	require.True(t, objective.Met(OpSummary{Count: 100, Errors: 1, Response: LatencySummary{P99: 100}}))
+	require.False(t, objective.Met(OpSummary{Count: 100, Errors: 2, Response: LatencySummary{P99: 100}}))
+	require.False(t, objective.Met(OpSummary{Count: 100, Response: LatencySummary{P99: 101}}))
+	require.False(t, objective.Met(OpSummary{}))
+}
@@ -0,0 +1,195 @@
+package thumperrunner
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ClosedLoopOptions represent the configuration for a closed-loop run.
+type ClosedLoopOptions struct {
+	// Workers are shared out between the virtual users, one each, so there
+	// should be at least as many workers as the concurrency.
+	Workers     []*Worker
+	Concurrency int
+	ThinkTime   time.Duration
+	Limits      RunLimits
+}
+
+// ClosedLoop runs a fixed number of virtual users, each of which issues a
+// step, waits for its result, optionally thinks, and then goes again. The
+// resulting rate is whatever the server can sustain at that concurrency.
+type ClosedLoop struct {
+	workers     []*Worker
+	concurrency int
+	thinkTime   time.Duration
+	limits      RunLimits
+
+	issued   atomic.Int64
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	// resumed is closed when a paused run resumes, and is nil while the run
+	// is not paused.
+	mu      sync.Mutex
+	resumed chan struct{}
+}
+
+// NewClosedLoop creates a closed-loop runner from the given options.
+func NewClosedLoop(options ClosedLoopOptions) *ClosedLoop {
+	return &ClosedLoop{
+		workers:     options.Workers,
+		concurrency: options.Concurrency,
+		thinkTime:   options.ThinkTime,
+		limits:      options.Limits,
+		stop:        make(chan struct{}),
+		stopped:     make(chan struct{}),
+	}
+}
+
+// Stop makes Run stop the virtual users, as if a run limit had been reached.
+func (c *ClosedLoop) Stop() {
+	c.stopOnce.Do(func() { close(c.stopped) })
+}
+
+// Pause makes the virtual users wait before their next step until Resume is
+// called.
+func (c *ClosedLoop) Pause() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed == nil {
+		log.Info().Msg("pausing virtual users")
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume lets paused virtual users continue.
+func (c *ClosedLoop) Resume() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.resumed != nil {
+		log.Info().Msg("resuming virtual users")
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// waitUntilResumed blocks while the run is paused, and returns false if the
+// run stops in the meantime.
+func (c *ClosedLoop) waitUntilResumed() bool {
+	c.mu.Lock()
+	resumed := c.resumed
+	c.mu.Unlock()
+
+	if resumed == nil {
+		return true
+	}
+
+	select {
+	case <-c.stop:
+		return false
+	case <-resumed:
+		return true
+	}
+}
+
+// Run starts the virtual users and blocks until the context is cancelled or
+// one of the run limits is reached, and then drains in-flight steps, returning
+// why it stopped. Steps are not cancelled along with the context, but only
+// once the drain timeout has passed.
+func (c *ClosedLoop) Run(ctx context.Context) string {
+	log.Info().
+		Int("concurrency", c.concurrency).
+		Dur("think-time", c.thinkTime).
+		Msg("starting virtual users")
+
+	stepCtx, cancelSteps := context.WithCancel(context.WithoutCancel(ctx))
+
+	var wg sync.WaitGroup
+	finished := make(chan struct{})
+	for i := 0; i < c.concurrency; i++ {
+		wg.Add(1)
+		worker := c.workers[i%len(c.workers)]
+		go func() {
+			defer wg.Done()
+			c.runUser(stepCtx, worker)
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	var deadline <-chan time.Time
+	if c.limits.Duration > 0 {
+		deadlineTimer := time.NewTimer(c.limits.Duration)
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+
+	var reason string
+	select {
+	case <-ctx.Done():
+		reason = "cancelled"
+	case <-deadline:
+		reason = "duration reached"
+	case <-c.stopped:
+		reason = "stopped"
+	case <-finished:
+		reason = "limits reached"
+	}
+
+	issued := c.issued.Load()
+	if c.limits.Requests > 0 {
+		issued = min(issued, int64(c.limits.Requests))
+	}
+	log.Info().Str("reason", reason).Int64("issued", issued).Msg("stopping virtual users, draining in-flight steps")
+	close(c.stop)
+	c.limits.drain(finished, cancelSteps)
+	return reason
+}
+
+func (c *ClosedLoop) runUser(ctx context.Context, worker *Worker) {
+	var think *time.Timer
+	if c.thinkTime > 0 {
+		think = time.NewTimer(c.thinkTime)
+		defer think.Stop()
+	}
+
+	for {
+		select {
+		case <-c.stop:
+			return
+		default:
+		}
+
+		if !c.waitUntilResumed() {
+			return
+		}
+
+		if issued := c.issued.Add(1); c.limits.Requests > 0 && issued > int64(c.limits.Requests) {
+			return
+		}
+
+		// A virtual user only issues its next step once it is ready to, so
+		// there is no schedule it could fall behind.
+		if !worker.Step(ctx, time.Now()) {
+			return
+		}
+
+		if think != nil {
+			think.Reset(c.thinkTime)
+			select {
+			case <-c.stop:
+				return
+			case <-think.C:
+			}
+		}
+	}
+}
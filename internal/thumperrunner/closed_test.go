@@ -0,0 +1,194 @@
+package thumperrunner
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// closedLoopWorkers creates a worker per virtual user, each running a script
+// of two steps with the given body.
+func closedLoopWorkers(t *testing.T, users int, body func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error), results *Results, limits RunLimits) []*Worker {
+	t.Helper()
+
+	scripts := []*ExecutableScript{{name: "reads", weight: 1, steps: []executableStep{
+		{op: "CheckPermission", body: body},
+		{op: "LookupResources", body: body},
+	}}}
+
+	workers := make([]*Worker, 0, users)
+	for index := range users {
+		worker, err := NewWorker(WorkerOptions{
+			Index:       index,
+			Clients:     NewClientPool(&authzed.Client{}),
+			Scripts:     scripts,
+			StepTimeout: time.Minute,
+			Results:     results,
+			Budget:      limits.Iterations,
+		})
+		require.NoError(t, err)
+		workers = append(workers, worker)
+	}
+	return workers
+}
+
+func instantStep(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error) {
+	return nil, nil
+}
+
+func totalCount(results *Results) uint64 {
+	summaries := results.Summary()
+	return summaries[len(summaries)-1].Count
+}
+
+func TestClosedLoopLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		limits         RunLimits
+		expectedReason string
+		expectedCount  uint64
+	}{
+		{"requests", RunLimits{Requests: 10}, "limits reached", 10},
+		{"iterations", RunLimits{Iterations: NewIterationBudget([]*ExecutableScript{{weight: 1, steps: make([]executableStep, 2)}}, 4)}, "limits reached", 8},
+		{"duration", RunLimits{Duration: 50 * time.Millisecond}, "duration reached", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := NewResults()
+			loop := NewClosedLoop(ClosedLoopOptions{
+				Workers:     closedLoopWorkers(t, 3, instantStep, results, tt.limits),
+				Concurrency: 3,
+				ThinkTime:   time.Millisecond,
+				Limits:      tt.limits,
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			require.Equal(t, tt.expectedReason, loop.Run(ctx))
+			if tt.expectedCount > 0 {
+				require.Equal(t, tt.expectedCount, totalCount(results))
+			} else {
+				require.Positive(t, totalCount(results))
+			}
+		})
+	}
+}
+
+func TestClosedLoopConcurrency(t *testing.T) {
+	const users = 3
+
+	var inFlight, peak atomic.Int64
+	release := make(chan struct{})
+	blocking := func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error) {
+		current := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			highest := peak.Load()
+			if current <= highest || peak.CompareAndSwap(highest, current) {
+				break
+			}
+		}
+		<-release
+		return nil, nil
+	}
+
+	results := NewResults()
+	loop := NewClosedLoop(ClosedLoopOptions{
+		Workers:     closedLoopWorkers(t, users, blocking, results, RunLimits{}),
+		Concurrency: users,
+	})
+
+	reason := make(chan string)
+	go func() {
+		reason <- loop.Run(context.Background())
+	}()
+
+	// Every user waits on its step, so no more are issued until they return.
+	require.Eventually(t, func() bool { return inFlight.Load() == users }, time.Second, time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+	require.Equal(t, int64(users), peak.Load())
+
+	// Stopping lets the steps in flight finish rather than cutting them off.
+	loop.Stop()
+	select {
+	case <-reason:
+		require.Fail(t, "run returned before its steps were drained")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(release)
+
+	require.Equal(t, "stopped", <-reason)
+	require.Zero(t, inFlight.Load())
+	require.Equal(t, int64(users), peak.Load())
+
+	summaries := results.Summary()
+	total := summaries[len(summaries)-1]
+	require.Equal(t, uint64(users), total.Count)
+	require.Zero(t, total.Errors)
+}
+
+func TestClosedLoopPause(t *testing.T) {
+	var steps atomic.Int64
+	counting := func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error) {
+		steps.Add(1)
+		return nil, nil
+	}
+
+	loop := NewClosedLoop(ClosedLoopOptions{
+		Workers:     closedLoopWorkers(t, 2, counting, NewResults(), RunLimits{}),
+		Concurrency: 2,
+		ThinkTime:   time.Millisecond,
+	})
+
+	reason := make(chan string)
+	go func() {
+		reason <- loop.Run(context.Background())
+	}()
+	require.Eventually(t, func() bool { return steps.Load() > 0 }, time.Second, time.Millisecond)
+
+	// Steps that were already past the pause check may still finish.
+	loop.Pause()
+	time.Sleep(20 * time.Millisecond)
+	paused := steps.Load()
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, paused, steps.Load())
+
+	loop.Resume()
+	require.Eventually(t, func() bool { return steps.Load() > paused }, time.Second, time.Millisecond)
+
+	// Stopping a paused run does not wait for it to be resumed.
+	loop.Pause()
+	loop.Stop()
+	require.Equal(t, "stopped", <-reason)
+}
+
+func TestClosedLoopDrainTimeout(t *testing.T) {
+	slow := func(ctx context.Context, _ *authzed.Client, _ *v1.ZedToken, _ *bindings) (*v1.ZedToken, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+
+	results := NewResults()
+	limits := RunLimits{Duration: 20 * time.Millisecond, DrainTimeout: 20 * time.Millisecond}
+	loop := NewClosedLoop(ClosedLoopOptions{
+		Workers:     closedLoopWorkers(t, 2, slow, results, limits),
+		Concurrency: 2,
+		Limits:      limits,
+	})
+
+	start := time.Now()
+	require.Equal(t, "duration reached", loop.Run(context.Background()))
+	require.Less(t, time.Since(start), 5*time.Second)
+
+	summaries := results.Summary()
+	total := summaries[len(summaries)-1]
+	require.Equal(t, uint64(2), total.Count)
+	require.Equal(t, uint64(2), total.Errors)
+}
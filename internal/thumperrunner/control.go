@@ -0,0 +1,66 @@
+package thumperrunner
+
+// Controller changes a run while it is in progress.
+type Controller struct {
+	scheduler *Scheduler
+	workers   []*Worker
+}
+
+// ControlStatus describes a run that is in progress.
+type ControlStatus struct {
+	SchedulerStatus
+
+	// Weights are the current weights of the scripts, by script name.
+	Weights map[string]uint
+}
+
+// NewController creates a controller for the given scheduler and the workers
+// it dispatches to.
+func NewController(scheduler *Scheduler, workers []*Worker) *Controller {
+	return &Controller{scheduler: scheduler, workers: workers}
+}
+
+// Status returns the current status of the run.
+func (c *Controller) Status() ControlStatus {
+	return ControlStatus{
+		SchedulerStatus: c.scheduler.Status(),
+		Weights:         c.workers[0].Weights(),
+	}
+}
+
+// SetQPS changes the target rate of the run.
+func (c *Controller) SetQPS(qps float64) error {
+	return c.scheduler.SetQPS(qps)
+}
+
+// Pause stops issuing requests until Resume is called.
+func (c *Controller) Pause() {
+	c.scheduler.Pause()
+}
+
+// Resume continues issuing requests after Pause.
+func (c *Controller) Resume() {
+	c.scheduler.Resume()
+}
+
+// SetWeights changes the weights of the named scripts on every worker. The
+// change is checked on every worker before it is made on any of them, since
+// workers with different budgets left may not all accept it.
+func (c *Controller) SetWeights(weights map[string]uint) error {
+	changes := make([]func(), 0, len(c.workers))
+	for _, worker := range c.workers {
+		worker.mu.Lock()
+		defer worker.mu.Unlock()
+
+		change, err := worker.weightChangeLocked(weights)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change)
+	}
+
+	for _, change := range changes {
+		change()
+	}
+	return nil
+}
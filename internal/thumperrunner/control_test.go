@@ -0,0 +1,98 @@
+package thumperrunner
+
+import (
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testController(t *testing.T, numWorkers int) *Controller {
+	t.Helper()
+
+	scripts := []*ExecutableScript{
+		{name: "read", weight: 3, steps: []executableStep{{op: "CheckPermission"}}},
+		{name: "write", weight: 1, steps: []executableStep{{op: "WriteRelationships"}}},
+	}
+
+	workers := make([]*Worker, 0, numWorkers)
+	for i := 0; i < numWorkers; i++ {
+		worker, err := NewWorker(WorkerOptions{Index: i, Scripts: scripts})
+		require.NoError(t, err)
+		workers = append(workers, worker)
+	}
+
+	return NewController(NewScheduler(SchedulerOptions{Workers: workers, QPS: 10}), workers)
+}
+
+func TestControllerRate(t *testing.T) {
+	controller := testController(t, 1)
+	require.InDelta(t, 10, controller.Status().TargetQPS, 0)
+
+	require.NoError(t, controller.SetQPS(250))
+	require.InDelta(t, 250, controller.scheduler.rate(0), 0)
+
+	require.Error(t, controller.SetQPS(0))
+	require.Error(t, controller.SetQPS(-1))
+
+	controller.Pause()
+	require.True(t, controller.Status().Paused)
+	require.InDelta(t, 250, controller.Status().TargetQPS, 0)
+	require.InDelta(t, 0, controller.scheduler.rate(0), 0)
+
+	controller.Resume()
+	require.False(t, controller.Status().Paused)
+	require.InDelta(t, 250, controller.scheduler.rate(0), 0)
+}
+
+func TestControllerReplacesProfile(t *testing.T) {
+	profile, err := NewRateProfile(&config.Profile{Stages: []config.ProfileStage{
+		{Type: "step", Duration: time.Minute, QPS: 100},
+	}}, 1)
+	require.NoError(t, err)
+
+	scheduler := NewScheduler(SchedulerOptions{Profile: profile})
+	require.InDelta(t, 100, scheduler.rate(0), 0)
+
+	require.NoError(t, scheduler.SetQPS(5))
+	require.InDelta(t, 5, scheduler.rate(0), 0)
+}
+
+func TestControllerWeights(t *testing.T) {
+	controller := testController(t, 3)
+	require.Equal(t, map[string]uint{"read": 3, "write": 1}, controller.Status().Weights)
+
+	require.NoError(t, controller.SetWeights(map[string]uint{"read": 0}))
+	for _, worker := range controller.workers {
+		require.Equal(t, map[string]uint{"read": 0, "write": 1}, worker.Weights())
+		for i := 0; i < 10; i++ {
+			require.Equal(t, 1, worker.chooser.Load().Pick())
+		}
+	}
+
+	require.ErrorContains(t, controller.SetWeights(map[string]uint{"delete": 1}), "unknown script")
+	require.Error(t, controller.SetWeights(map[string]uint{"write": 0}))
+	for _, worker := range controller.workers {
+		require.Equal(t, map[string]uint{"read": 0, "write": 1}, worker.Weights())
+	}
+}
+
+func TestControllerWeightsAllOrNothing(t *testing.T) {
+	controller := testController(t, 2)
+
+	// The second worker has run out of writes, so it has nothing left to
+	// pick once reads have no weight, while the first still has writes.
+	scripts := []*ExecutableScript{controller.workers[0].contexts[0].script, controller.workers[0].contexts[1].script}
+	budget := NewIterationBudget(scripts, 1)
+	require.True(t, budget.take(1, 1))
+	worker, err := NewWorker(WorkerOptions{Index: 1, Scripts: scripts, Budget: budget})
+	require.NoError(t, err)
+	controller.workers[1] = worker
+
+	require.Error(t, controller.SetWeights(map[string]uint{"read": 0}))
+	for _, worker := range controller.workers {
+		require.Equal(t, map[string]uint{"read": 3, "write": 1}, worker.Weights())
+	}
+}
@@ -3,17 +3,75 @@ package thumperrunner
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"sync"
 	"time"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
 	"github.com/authzed/authzed-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/rs/zerolog/log"
 )
 
+// LatencyBuckets are the histogram buckets, in seconds, used for all latency
+// metrics.
+var LatencyBuckets = []float64{.006, .010, .018, .024, .032, .042, .056, .075, .100, .178, .316, .562, 1.000}
+
+var (
+	serviceTimeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thumper",
+		Name:      "step_service_time_seconds",
+		Help:      "Time from sending a script step until it completed.",
+		Buckets:   LatencyBuckets,
+	}, []string{"op"})
+
+	responseTimeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "thumper",
+		Name:      "step_response_time_seconds",
+		Help:      "Time from when a script step was scheduled to be sent until it completed.",
+		Buckets:   LatencyBuckets,
+	}, []string{"op"})
+)
+
 type executableStep struct {
 	op          string
 	consistency string
-	body        func(context.Context, *authzed.Client, *v1.ZedToken) (*v1.ZedToken, error)
+	body        func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error)
+
+	// sleep is set for Sleep steps, which wait for the drawn duration instead
+	// of making a call.
+	sleep func(*rand.Rand) time.Duration
+
+	// flow is set for steps without an op, which run the steps nested in
+	// them instead.
+	flow *controlFlow
+
+	// updates is set for WriteRelationships steps, and returns the updates
+	// the step writes with the given bindings, which the worker reports to
+	// its watcher once they are written.
+	updates func(*bindings) ([]*v1.RelationshipUpdate, error)
+
+	// continueOnError keeps the steps after this one running when it fails.
+	continueOnError bool
+
+	// timeout, when set, bounds the step instead of the step timeout of the
+	// worker.
+	timeout time.Duration
+}
+
+// wait sleeps for the duration drawn by a Sleep step, returning early with an
+// error if the context is cancelled.
+func (step executableStep) wait(ctx context.Context, rng *rand.Rand) error {
+	timer := time.NewTimer(step.sleep(rng))
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
 }
 
 // ExecutableScript is a thumper yaml script that has been post-processed for
@@ -21,24 +79,123 @@ type executableStep struct {
 type ExecutableScript struct {
 	name   string
 	weight uint
+	qps    float64
 	steps  []executableStep
+
+	// session runs all steps in order every time the script is picked,
+	// rather than a single step.
+	session bool
+
+	// followsPrevious is set when an if of the script depends on the
+	// outcome of the step before it, which only runs in order in a session
+	// or a migration.
+	followsPrevious bool
+}
+
+// PinnedQPS returns the total rate of the scripts that run at a rate of their
+// own rather than by weight.
+func PinnedQPS(scripts []*ExecutableScript) float64 {
+	var total float64
+	for _, script := range scripts {
+		total += script.qps
+	}
+	return total
 }
 
 type ExecutableContext struct {
-	script *ExecutableScript
-	client *authzed.Client
+	script  *ExecutableScript
+	clients *ClientPool
+	results *Results
+	breaker *CircuitBreaker
+	watcher *Watcher
 
+	// mu guards the position in the script, the latest token, and the
+	// bindings of the current pass over the script, since steps of the same
+	// context may run concurrently.
+	mu          sync.Mutex
 	numExecuted int
 	zedToken    *v1.ZedToken
+	bindings    *bindings
 }
 
-// StepForward advances the script one step and then stops.
-func (s *ExecutableContext) StepForward(workerIndex int, stepTimeout time.Duration) {
-	ctx, cancel := context.WithTimeout(context.Background(), stepTimeout)
-	defer cancel()
+// reserve advances the position in the script by one step, returning the step
+// and the bindings of its pass over the script. Every pass draws new values
+// for its placeholders from the generator of the iteration that starts it.
+func (s *ExecutableContext) reserve(rng *rand.Rand) (int, *bindings) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
 	stepNum := s.numExecuted % len(s.script.steps)
-	step := s.script.steps[stepNum]
+	s.numExecuted++
+	if stepNum == 0 || s.bindings == nil {
+		s.bindings = newBindings(rng)
+	}
+	return stepNum, s.bindings
+}
+
+// StepForward runs the step of the script that the iteration reserved and then
+// stops, drawing its random choices from the generator of the iteration. The
+// scheduled time is when the step was meant to start, which is used to
+// measure its response time.
+func (s *ExecutableContext) StepForward(ctx context.Context, workerIndex int, stepTimeout time.Duration, scheduled time.Time, it *iteration) {
+	s.mu.Lock()
+	zedToken := s.zedToken
+	s.mu.Unlock()
+
+	stepNum, b, rng := it.stepNum, it.bindings, it.rng
+
+	// A step with control flow runs all of the steps it picks, which are
+	// measured like the steps of a session.
+	w := &walker{bindings: b, rng: rng}
+	w.run = func(step executableStep) error {
+		var err error
+		zedToken, err = s.runStep(ctx, workerIndex, stepTimeout, stepNum, step, zedToken, b, scheduled, rng)
+		scheduled = time.Now()
+		return err
+	}
+	_ = w.walk(s.script.steps[stepNum : stepNum+1])
+
+	s.mu.Lock()
+	s.zedToken = zedToken
+	s.mu.Unlock()
+}
+
+// RunSession runs every step of the script in order, each once the previous
+// one has finished, passing the ZedToken of each step on to the next. The
+// session ends early if a step fails, since later steps usually depend on
+// it, unless the step continues on errors. The first step is measured from
+// the scheduled time, and later steps from when the step before them
+// finished. Steps are numbered in the order they run, which differs from
+// their place in the script when it has control flow. Random choices are
+// drawn from the generator of the iteration.
+func (s *ExecutableContext) RunSession(ctx context.Context, workerIndex int, stepTimeout time.Duration, scheduled time.Time, rng *rand.Rand) {
+	var zedToken *v1.ZedToken
+	var stepNum int
+	b := newBindings(rng)
+
+	w := &walker{bindings: b, rng: rng}
+	w.run = func(step executableStep) error {
+		var err error
+		zedToken, err = s.runStep(ctx, workerIndex, stepTimeout, stepNum, step, zedToken, b, scheduled, rng)
+		stepNum++
+		scheduled = time.Now()
+		return err
+	}
+	_ = w.walk(s.script.steps)
+}
+
+func (s *ExecutableContext) runStep(ctx context.Context, workerIndex int, stepTimeout time.Duration, stepNum int, step executableStep, zedToken *v1.ZedToken, b *bindings, scheduled time.Time, rng *rand.Rand) (*v1.ZedToken, error) {
+	// Sleeps are not requests, so they are neither bound by the step timeout
+	// nor recorded.
+	if step.sleep != nil {
+		return zedToken, step.wait(ctx, rng)
+	}
+
+	if step.timeout > 0 {
+		stepTimeout = step.timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, stepTimeout)
+	defer cancel()
 
 	log.Debug().
 		Str("script", s.script.name).
@@ -48,7 +205,24 @@ func (s *ExecutableContext) StepForward(workerIndex int, stepTimeout time.Durati
 		Str("consistency", step.consistency).
 		Msg("executing script step")
 
-	newToken, err := step.body(ctx, s.client, s.zedToken)
+	start := time.Now()
+	newToken, err := step.body(ctx, s.clients.Next(), zedToken, b)
+	finished := time.Now()
+
+	service, response := finished.Sub(start), finished.Sub(scheduled)
+	serviceTimeHistogram.WithLabelValues(step.op).Observe(service.Seconds())
+	responseTimeHistogram.WithLabelValues(step.op).Observe(response.Seconds())
+	if s.results != nil {
+		s.results.record(step.op, service, response, err)
+	}
+	if s.breaker != nil {
+		s.breaker.record(err != nil)
+	}
+	if s.watcher != nil && step.updates != nil && err == nil {
+		if updates, err := step.updates(b); err == nil {
+			s.watcher.written(updates, finished)
+		}
+	}
 	if err != nil {
 		log.Warn().
 			Str("script", s.script.name).
@@ -60,23 +234,34 @@ func (s *ExecutableContext) StepForward(workerIndex int, stepTimeout time.Durati
 			Msg("error calling script step")
 	}
 
-	s.numExecuted++
-	s.zedToken = newToken
+	return newToken, err
 }
 
-// RunOnce runs all steps in a script and then stops.
-func (s *ExecutableScript) RunOnce(client *authzed.Client) error {
+// RunOnce runs all steps in a script and then stops, drawing the length of
+// any sleeps from the given generator.
+func (s *ExecutableScript) RunOnce(ctx context.Context, client *authzed.Client, rng *rand.Rand) error {
 	log.Info().Str("script", s.name).Msg("running migration script")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3600*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3600*time.Second)
 	defer cancel()
 
-	for stepNum, step := range s.steps {
-		log.Debug().Int("step", stepNum).Int("total", len(s.steps)).Msg("executing migration step")
-		_, err := step.body(ctx, client, nil)
-		if err != nil {
-			return fmt.Errorf("error running script %s: %w", s.name, err)
+	var stepNum int
+	b := newBindings(rng)
+
+	w := &walker{bindings: b, rng: rng}
+	w.run = func(step executableStep) error {
+		log.Debug().Int("step", stepNum).Str("op", step.op).Msg("executing migration step")
+		stepNum++
+
+		if step.sleep != nil {
+			return step.wait(ctx, rng)
 		}
+
+		_, err := step.body(ctx, client, nil, b)
+		return err
+	}
+	if err := w.walk(s.steps); err != nil {
+		return fmt.Errorf("error running script %s: %w", s.name, err)
 	}
 
 	return nil
@@ -0,0 +1,163 @@
+package thumperrunner
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+// conditionalSuffix marks results that depend on a caveat whose context was
+// missing from the request.
+const conditionalSuffix = "(conditional)"
+
+// expectedResults are the results a streaming step is expected to return,
+// described the same way as the results it returns. They may contain
+// placeholders, which are resolved when the results are compared.
+type expectedResults struct {
+	results []string
+
+	// subset allows results to be returned that were not expected.
+	subset bool
+
+	// canonical, when set, rewrites the expected results into the form of
+	// the returned ones.
+	canonical func(string) string
+}
+
+// verify compares the results a step returned to the expected results,
+// returning an error listing the differences between them.
+func (e *expectedResults) verify(b *bindings, returned []string) error {
+	expected := make([]string, 0, len(e.results))
+	for _, result := range e.results {
+		expanded, err := b.expand(result)
+		if err != nil {
+			return err
+		}
+		if e.canonical != nil {
+			expanded = e.canonical(expanded)
+		}
+		expected = append(expected, expanded)
+	}
+
+	missing, unexpected := diffResults(expected, returned)
+	if e.subset {
+		unexpected = nil
+	}
+	if len(missing) == 0 && len(unexpected) == 0 {
+		return nil
+	}
+
+	var diff strings.Builder
+	diff.WriteString("results differ from the expected results (-expected +returned):")
+	for _, result := range missing {
+		diff.WriteString("\n- " + result)
+	}
+	for _, result := range unexpected {
+		diff.WriteString("\n+ " + result)
+	}
+	return fmt.Errorf("%s", diff.String())
+}
+
+// diffResults returns the expected results that were not returned, and the
+// returned results that were not expected, both sorted. Results that appear
+// more than once must be returned as many times as they are expected.
+func diffResults(expected, returned []string) (missing, unexpected []string) {
+	counts := make(map[string]int, len(expected))
+	for _, result := range expected {
+		counts[result]++
+	}
+	for _, result := range returned {
+		if counts[result] > 0 {
+			counts[result]--
+			continue
+		}
+		unexpected = append(unexpected, result)
+	}
+	for result, count := range counts {
+		for ; count > 0; count-- {
+			missing = append(missing, result)
+		}
+	}
+
+	slices.Sort(missing)
+	slices.Sort(unexpected)
+	return missing, unexpected
+}
+
+// describeResult describes a result of a lookup: its ID, followed by the IDs
+// it excludes if it is a wildcard, and marked if it is conditional. For
+// example "doc1", "* - tom, fred", or "doc2 (conditional)".
+func describeResult(id string, excluded []string, conditional bool) string {
+	description := id
+	if len(excluded) > 0 {
+		excluded = slices.Clone(excluded)
+		slices.Sort(excluded)
+		description += " - " + strings.Join(excluded, ", ")
+	}
+	if conditional {
+		description += " " + conditionalSuffix
+	}
+	return description
+}
+
+// describeRelationship describes a relationship in the form
+// resource#relation@subject, followed by its caveat and expiration if it has
+// them, such as
+// document:readme#viewer@user:tom[on_weekdays:{"day":"monday"}][expiration:2030-01-01T00:00:00Z].
+func describeRelationship(relationship *v1.Relationship) string {
+	var description strings.Builder
+	resource := relationship.Resource
+	fmt.Fprintf(&description, "%s:%s#%s@%s", resource.ObjectType, resource.ObjectId, relationship.Relation, describeSubject(relationship.Subject))
+
+	if caveat := relationship.OptionalCaveat; caveat != nil {
+		description.WriteString("[" + caveat.CaveatName)
+		if len(caveat.Context.GetFields()) > 0 {
+			// Maps are encoded with sorted keys, so equal contexts are
+			// always described the same way.
+			encoded, _ := json.Marshal(caveat.Context.AsMap())
+			description.WriteString(":" + string(encoded))
+		}
+		description.WriteString("]")
+	}
+
+	if expiration := relationship.OptionalExpiresAt; expiration != nil {
+		description.WriteString("[expiration:" + expiration.AsTime().UTC().Format(time.RFC3339) + "]")
+	}
+
+	return description.String()
+}
+
+// describeSubject describes a subject in the form type:id, followed by
+// #relation if it has one.
+func describeSubject(subject *v1.SubjectReference) string {
+	description := subject.Object.ObjectType + ":" + subject.Object.ObjectId
+	if subject.OptionalRelation != "" {
+		description += "#" + subject.OptionalRelation
+	}
+	return description
+}
+
+// canonicalResult returns an expected result in the form of describeResult,
+// so that it can be written with any spacing and order of exclusions.
+func canonicalResult(result string) string {
+	result = strings.TrimSpace(result)
+
+	conditional := strings.HasSuffix(result, conditionalSuffix)
+	result = strings.TrimSpace(strings.TrimSuffix(result, conditionalSuffix))
+
+	var excluded []string
+	if rest, ok := strings.CutPrefix(result, "*"); ok {
+		if rest, ok = strings.CutPrefix(strings.TrimSpace(rest), "-"); ok {
+			result = "*"
+			for _, id := range strings.Split(rest, ",") {
+				excluded = append(excluded, strings.TrimSpace(id))
+			}
+		}
+	}
+
+	return describeResult(result, excluded, conditional)
+}
@@ -0,0 +1,197 @@
+package thumperrunner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestCanonicalResult(t *testing.T) {
+	tests := []struct {
+		result   string
+		expected string
+	}{
+		{"doc1", "doc1"},
+		{" doc1 ", "doc1"},
+		{"user-1", "user-1"},
+		{"doc1(conditional)", "doc1 (conditional)"},
+		{"*", "*"},
+		{"*-fred,tom", "* - fred, tom"},
+		{"* - tom, fred (conditional)", "* - fred, tom (conditional)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.result, func(t *testing.T) {
+			require.Equal(t, tt.expected, canonicalResult(tt.result))
+		})
+	}
+}
+
+func TestExpectedResultsVerify(t *testing.T) {
+	b := newBindings(NewRand(1))
+	b.capture("docs", []map[string]string{{"": "doc1"}})
+
+	tests := []struct {
+		name        string
+		expected    []string
+		subset      bool
+		returned    []string
+		expectedErr string
+	}{
+		{"same order", []string{"doc1", "doc2"}, false, []string{"doc1", "doc2"}, ""},
+		{"any order", []string{"doc2", "doc1"}, false, []string{"doc1", "doc2"}, ""},
+		{"none", []string{}, false, nil, ""},
+		{"captured", []string{"${capture:docs}"}, false, []string{"doc1"}, ""},
+		{"subset", []string{"doc2"}, true, []string{"doc1", "doc2"}, ""},
+		{"wrong result", []string{"doc1", "doc2"}, false, []string{"doc1", "doc3"}, "results differ from the expected results (-expected +returned):\n- doc2\n+ doc3"},
+		{"missing from subset", []string{"doc1", "doc2"}, true, []string{"doc1", "doc3"}, "results differ from the expected results (-expected +returned):\n- doc2"},
+		{"duplicate", []string{"doc1"}, false, []string{"doc1", "doc1"}, "results differ from the expected results (-expected +returned):\n+ doc1"},
+		{"not conditional", []string{"doc1 (conditional)"}, false, []string{"doc1"}, "results differ from the expected results (-expected +returned):\n- doc1 (conditional)\n+ doc1"},
+		{"unknown capture", []string{"${capture:missing}"}, false, nil, "nothing has been captured as missing"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expected := &expectedResults{results: tt.expected, subset: tt.subset, canonical: canonicalResult}
+			err := expected.verify(b, tt.returned)
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
+
+func TestLookupExpectedResults(t *testing.T) {
+	client := startFakeServer(t, &fakePermissions{
+		resources: []string{"doc1", "doc2"},
+		subjects: []*v1.LookupSubjectsResponse{
+			{Subject: &v1.ResolvedSubject{SubjectObjectId: "tom", Permissionship: v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION}},
+			{Subject: &v1.ResolvedSubject{SubjectObjectId: "fred", Permissionship: v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION}},
+			{
+				Subject: &v1.ResolvedSubject{SubjectObjectId: "*", Permissionship: v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_HAS_PERMISSION},
+				ExcludedSubjects: []*v1.ResolvedSubject{
+					{SubjectObjectId: "tom"},
+					{SubjectObjectId: "fred"},
+				},
+			},
+		},
+	})
+	resources := config.ScriptStep{Op: "LookupResources", Resource: "document", Permission: "view", Subject: "user:tom"}
+	subjects := config.ScriptStep{Op: "LookupSubjects", Resource: "document:readme", Permission: "view", Subject: "user"}
+
+	tests := []struct {
+		name        string
+		step        config.ScriptStep
+		expectedErr string
+	}{
+		{"resources", withExpected(resources, []string{"doc2", "doc1"}, nil), ""},
+		{"wrong resources", withExpected(resources, []string{"doc1", "doc3"}, nil), "LookupResources error: results differ from the expected results (-expected +returned):\n- doc3\n+ doc2"},
+		{"subjects", withExpected(subjects, nil, []string{"tom", "fred (conditional)", "* - tom, fred"}), ""},
+		{"wrong subjects", withExpected(subjects, nil, []string{"tom", "fred", "*"}), "LookupSubjects error: results differ from the expected results (-expected +returned):\n- *\n- fred\n+ * - fred, tom\n+ fred (conditional)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := prepareStep(tt.step)
+			require.NoError(t, err)
+
+			_, err = step.body(context.Background(), client, nil, newBindings(NewRand(1)))
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+		})
+	}
+
+	_, err := prepareStep(withExpected(resources, nil, []string{"tom"}))
+	require.EqualError(t, err, "LookupResources steps cannot expect subjects")
+
+	resources.NumExpected = 3
+	_, err = prepareStep(withExpected(resources, []string{"doc1"}, nil))
+	require.EqualError(t, err, "error preparing LookupResources expectedResources: numExpected is 3, but 1 results are expected")
+}
+
+func TestReadExpectedRelationships(t *testing.T) {
+	caveatContext, err := structpb.NewStruct(map[string]any{"day": "monday", "hour": 9})
+	require.NoError(t, err)
+
+	client := startFakeServer(t, &fakePermissions{
+		relationships: []*v1.Relationship{
+			{
+				Resource: &v1.ObjectReference{ObjectType: "document", ObjectId: "readme"},
+				Relation: "viewer",
+				Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "tom"}},
+			},
+			{
+				Resource:          &v1.ObjectReference{ObjectType: "document", ObjectId: "readme"},
+				Relation:          "viewer",
+				Subject:           &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "group", ObjectId: "eng"}, OptionalRelation: "member"},
+				OptionalCaveat:    &v1.ContextualizedCaveat{CaveatName: "on_weekdays", Context: caveatContext},
+				OptionalExpiresAt: timestamppb.New(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)),
+			},
+		},
+	})
+
+	tom := config.Relationship{Resource: "document:readme", Relation: "viewer", Subject: "user:tom"}
+	eng := config.Relationship{
+		Resource:   "document:readme",
+		Relation:   "viewer",
+		Subject:    "group:eng#member",
+		Caveat:     &config.CaveatContext{Name: "on_weekdays", Context: (*config.ProtoStruct)(caveatContext)},
+		Expiration: "2030-01-01T01:00:00+01:00",
+	}
+	read := func(match string, relationships ...config.Relationship) config.ScriptStep {
+		if relationships == nil {
+			relationships = []config.Relationship{}
+		}
+		return config.ScriptStep{Op: "ReadRelationships", Resource: "document:readme", Match: match, ExpectedRelationships: relationships}
+	}
+
+	tests := []struct {
+		name        string
+		step        config.ScriptStep
+		expectedErr string
+	}{
+		{"exact", read("", eng, tom), ""},
+		{"subset", read("subset", tom), ""},
+		{"missing", read("exact", tom), "ReadRelationships error: results differ from the expected results (-expected +returned):\n" +
+			`+ document:readme#viewer@group:eng#member[on_weekdays:{"day":"monday","hour":9}][expiration:2030-01-01T00:00:00Z]`},
+		{"none", read(""), "ReadRelationships error: results differ from the expected results (-expected +returned):\n" +
+			`+ document:readme#viewer@group:eng#member[on_weekdays:{"day":"monday","hour":9}][expiration:2030-01-01T00:00:00Z]` + "\n" +
+			"+ document:readme#viewer@user:tom"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := prepareStep(tt.step)
+			require.NoError(t, err)
+
+			_, err = step.body(context.Background(), client, nil, newBindings(NewRand(1)))
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+		})
+	}
+
+	invalid := read("subset", tom)
+	invalid.NumExpected = 1
+	_, err = prepareStep(invalid)
+	require.EqualError(t, err, "error preparing ReadRelationships expectedRelationships: numExpected cannot be combined with a subset match")
+
+	_, err = prepareStep(read("some", tom))
+	require.EqualError(t, err, "error preparing ReadRelationships expectedRelationships: unknown match: some")
+}
+
+func withExpected(step config.ScriptStep, resources, subjects []string) config.ScriptStep {
+	step.ExpectedResources = resources
+	step.ExpectedSubjects = subjects
+	return step
+}
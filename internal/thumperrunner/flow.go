@@ -0,0 +1,99 @@
+package thumperrunner
+
+import (
+	"math/rand"
+
+	"github.com/mroth/weightedrand"
+)
+
+// controlFlow is the part of a step that runs other steps: a number of times
+// with repeat, one of several weighted branches with choose, or depending on
+// a condition with if.
+type controlFlow struct {
+	repeat uint
+
+	// branches picks one of the branches of a choose, each of which is a
+	// []executableStep.
+	branches *weightedrand.Chooser
+
+	condition *condition
+	steps     []executableStep
+	otherwise []executableStep
+}
+
+// condition decides which steps an if runs.
+type condition struct {
+	// captured is met when the capture with this name holds any results.
+	captured string
+
+	// previous is met when the step before the if succeeded, or failed.
+	previous string
+
+	not bool
+}
+
+// met returns whether the condition holds, given the bindings of the
+// iteration and the error of the step before it.
+func (c *condition) met(b *bindings, previous error) bool {
+	var met bool
+	switch {
+	case c.captured != "":
+		met = b.hasCaptured(c.captured)
+	case c.previous == "failed":
+		met = previous != nil
+	default:
+		met = previous == nil
+	}
+	return met != c.not
+}
+
+// walker runs steps in order, following their control flow, and hands every
+// step that makes a call or sleeps to run.
+type walker struct {
+	bindings *bindings
+	rng      *rand.Rand
+	run      func(executableStep) error
+
+	// previous is the outcome of the last step that made a call.
+	previous error
+}
+
+// walk runs the given steps, and returns the error of the first one that
+// fails, unless the step continues on errors.
+func (w *walker) walk(steps []executableStep) error {
+	for _, step := range steps {
+		if step.flow == nil {
+			err := w.run(step)
+			if step.sleep == nil {
+				w.previous = err
+			}
+			if err != nil && !step.continueOnError {
+				return err
+			}
+			continue
+		}
+
+		if err := w.walkFlow(step.flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *walker) walkFlow(flow *controlFlow) error {
+	switch {
+	case flow.repeat > 0:
+		for i := uint(0); i < flow.repeat; i++ {
+			if err := w.walk(flow.steps); err != nil {
+				return err
+			}
+		}
+		return nil
+	case flow.branches != nil:
+		return w.walk(flow.branches.PickSource(w.rng).([]executableStep))
+	case flow.condition.met(w.bindings, w.previous):
+		return w.walk(flow.steps)
+	default:
+		return w.walk(flow.otherwise)
+	}
+}
@@ -0,0 +1,233 @@
+package thumperrunner
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWalkerFlow(t *testing.T) {
+	failed := errors.New("failed")
+	leaf := func(op string) executableStep { return executableStep{op: op} }
+
+	tests := []struct {
+		name        string
+		steps       []executableStep
+		captured    []map[string]string
+		fail        map[string]bool
+		expected    []string
+		expectedErr error
+	}{
+		{
+			name: "repeat",
+			steps: []executableStep{
+				{flow: &controlFlow{repeat: 3, steps: []executableStep{leaf("read"), leaf("write")}}},
+				leaf("done"),
+			},
+			expected: []string{"read", "write", "read", "write", "read", "write", "done"},
+		},
+		{
+			name: "if captured",
+			steps: []executableStep{
+				{flow: &controlFlow{condition: &condition{captured: "docs"}, steps: []executableStep{leaf("share")}, otherwise: []executableStep{leaf("create")}}},
+			},
+			captured: []map[string]string{{"": "doc1"}},
+			expected: []string{"share"},
+		},
+		{
+			name: "if not captured",
+			steps: []executableStep{
+				{flow: &controlFlow{condition: &condition{captured: "docs"}, steps: []executableStep{leaf("share")}, otherwise: []executableStep{leaf("create")}}},
+			},
+			expected: []string{"create"},
+		},
+		{
+			name: "if not negated",
+			steps: []executableStep{
+				{flow: &controlFlow{condition: &condition{captured: "docs", not: true}, steps: []executableStep{leaf("create")}}},
+			},
+			captured: []map[string]string{{"": "doc1"}},
+		},
+		{
+			name: "previous failed",
+			steps: []executableStep{
+				{op: "read", continueOnError: true},
+				{flow: &controlFlow{condition: &condition{previous: "failed"}, steps: []executableStep{leaf("retry")}}},
+			},
+			fail:     map[string]bool{"read": true},
+			expected: []string{"read", "retry"},
+		},
+		{
+			name: "previous succeeded",
+			steps: []executableStep{
+				leaf("read"),
+				{flow: &controlFlow{condition: &condition{previous: "succeeded"}, steps: []executableStep{leaf("share")}}},
+			},
+			expected: []string{"read", "share"},
+		},
+		{
+			name: "failure stops every level",
+			steps: []executableStep{
+				{flow: &controlFlow{repeat: 2, steps: []executableStep{leaf("read"), leaf("write")}}},
+				leaf("done"),
+			},
+			fail:        map[string]bool{"read": true},
+			expected:    []string{"read"},
+			expectedErr: failed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBindings(NewRand(1))
+			if tt.captured != nil {
+				b.capture("docs", tt.captured)
+			}
+
+			var ran []string
+			w := &walker{bindings: b, rng: NewRand(1), run: func(step executableStep) error {
+				ran = append(ran, step.op)
+				if tt.fail[step.op] {
+					return failed
+				}
+				return nil
+			}}
+
+			require.Equal(t, tt.expectedErr, w.walk(tt.steps))
+			require.Equal(t, tt.expected, ran)
+		})
+	}
+}
+
+func TestWalkerChoose(t *testing.T) {
+	steps, err := prepareSteps("test", "", []config.ScriptStep{{
+		Choose: []config.Branch{
+			{Weight: 7, Steps: []config.ScriptStep{{Op: "Sleep", Duration: 1}}},
+			{Weight: 3, Steps: []config.ScriptStep{{Op: "Sleep", Duration: 1}, {Op: "Sleep", Duration: 1}}},
+		},
+	}}, map[string]bool{})
+	require.NoError(t, err)
+
+	var ran int
+	w := &walker{bindings: newBindings(NewRand(1)), rng: NewRand(1), run: func(executableStep) error {
+		ran++
+		return nil
+	}}
+
+	const iterations = 10000
+	for i := 0; i < iterations; i++ {
+		require.NoError(t, w.walk(steps))
+	}
+
+	// Every pick of the second branch runs one more step than the first.
+	require.InDelta(t, 0.3, float64(ran-iterations)/iterations, 0.02)
+}
+
+func TestPreviousOutcome(t *testing.T) {
+	script := func(mode string) *config.Script {
+		return &config.Script{Name: "retry", Weight: 1, Mode: mode, Steps: []config.ScriptStep{
+			{Op: "WriteRelationships", ContinueOnError: true, Updates: []config.Update{{Op: "CREATE", Resource: "document:readme", Relation: "viewer", Subject: "user:tom"}}},
+			{If: &config.Condition{Previous: "failed"}, Steps: []config.ScriptStep{{Op: "ReadRelationships", Resource: "document"}}},
+		}}
+	}
+
+	tests := []struct {
+		name        string
+		mode        string
+		migration   bool
+		expectedErr string
+	}{
+		{"step mode", "step", false, "script retry has an if on the previous step, which requires mode: session"},
+		{"step mode migration", "step", true, ""},
+		{"session", "session", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakePermissions{writeErr: status.Error(codes.AlreadyExists, "relationship already existed")}
+			client := startFakeServer(t, fake)
+
+			prepared, err := Prepare([]*config.Script{script(tt.mode)})
+			require.NoError(t, err)
+
+			if tt.migration {
+				require.NoError(t, prepared[0].RunOnce(context.Background(), client, NewRand(1)))
+				require.Equal(t, int64(1), fake.streamed.Load())
+				return
+			}
+
+			worker, err := NewWorker(WorkerOptions{
+				Clients:     NewClientPool(client),
+				Scripts:     prepared,
+				StepTimeout: time.Second,
+			})
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			require.True(t, worker.Step(context.Background(), time.Now()))
+			require.Equal(t, int64(1), fake.streamed.Load())
+		})
+	}
+}
+
+func TestPrepareFlow(t *testing.T) {
+	read := config.ScriptStep{Op: "LookupResources", Resource: "document", Permission: "view", Subject: "user:tom", Capture: "docs"}
+	share := config.ScriptStep{Op: "CheckPermission", Resource: "document:${capture:docs}", Permission: "share", Subject: "user:tom"}
+
+	tests := []struct {
+		name        string
+		steps       []config.ScriptStep
+		expectedErr string
+	}{
+		{"read or read then share", []config.ScriptStep{{Choose: []config.Branch{
+			{Weight: 70, Steps: []config.ScriptStep{read}},
+			{Weight: 30, Steps: []config.ScriptStep{read, share}},
+		}}}, ""},
+		{"if captured", []config.ScriptStep{read, {If: &config.Condition{Captured: "docs"}, Steps: []config.ScriptStep{share}}}, ""},
+		{"no op and no flow", []config.ScriptStep{{}}, "step 0 of script test must have an op, or exactly one of repeat, choose, or if"},
+		{"two flows", []config.ScriptStep{{Repeat: 2, If: &config.Condition{Previous: "failed"}, Steps: []config.ScriptStep{read}}}, "step 0 of script test must have an op, or exactly one of repeat, choose, or if"},
+		{"op with flow", []config.ScriptStep{{Op: "Sleep", Duration: 1, Repeat: 2}}, "Sleep steps cannot have control flow"},
+		{"repeat without steps", []config.ScriptStep{{Repeat: 2}}, "step 0 of script test has no steps"},
+		{"else without if", []config.ScriptStep{{Repeat: 2, Steps: []config.ScriptStep{read}, Else: []config.ScriptStep{read}}}, "step 0 of script test has else steps without an if"},
+		{"empty branch", []config.ScriptStep{{Choose: []config.Branch{{Weight: 1}}}}, "step 0.choose0 of script test has no steps"},
+		{"zero weights", []config.ScriptStep{{Choose: []config.Branch{{Steps: []config.ScriptStep{read}}}}}, "error preparing the branches of step 0 of script test: zero Choices with Weight >= 1"},
+		{"if without condition", []config.ScriptStep{{If: &config.Condition{}, Steps: []config.ScriptStep{read}}}, "the if of step 0 of script test must have exactly one of captured or previous"},
+		{"unknown outcome", []config.ScriptStep{{If: &config.Condition{Previous: "skipped"}, Steps: []config.ScriptStep{read}}}, "unknown previous outcome in the if of step 0 of script test: skipped"},
+		{"if on unknown capture", []config.ScriptStep{{If: &config.Condition{Captured: "docs"}, Steps: []config.ScriptStep{read}}}, "step 0 of script test uses capture docs before any step captures it"},
+		{"use after capture in every branch", []config.ScriptStep{{Choose: []config.Branch{
+			{Weight: 1, Steps: []config.ScriptStep{read}},
+			{Weight: 1, Steps: []config.ScriptStep{read, share}},
+		}}, share}, ""},
+		{"use after capture in one branch", []config.ScriptStep{{Choose: []config.Branch{
+			{Weight: 1, Steps: []config.ScriptStep{read}},
+			{Weight: 1, Steps: []config.ScriptStep{{Op: "Sleep", Duration: 1}}},
+		}}, share}, "step 1 of script test uses capture docs before any step captures it"},
+		{"use in another branch", []config.ScriptStep{{Choose: []config.Branch{
+			{Weight: 1, Steps: []config.ScriptStep{read}},
+			{Weight: 1, Steps: []config.ScriptStep{share}},
+		}}}, "step 0.choose1.0 of script test uses capture docs before any step captures it"},
+		{"use in else", []config.ScriptStep{{If: &config.Condition{Previous: "failed"}, Steps: []config.ScriptStep{read}, Else: []config.ScriptStep{share}}}, "step 0.else.0 of script test uses capture docs before any step captures it"},
+		{"use after capture in then and else", []config.ScriptStep{{If: &config.Condition{Previous: "failed"}, Steps: []config.ScriptStep{read}, Else: []config.ScriptStep{read}}, share}, ""},
+		{"use after capture in if without else", []config.ScriptStep{{If: &config.Condition{Previous: "failed"}, Steps: []config.ScriptStep{read}}, share}, "step 1 of script test uses capture docs before any step captures it"},
+		{"use after repeat", []config.ScriptStep{{Repeat: 2, Steps: []config.ScriptStep{read}}, share}, ""},
+		{"nested use before capture", []config.ScriptStep{{Repeat: 2, Steps: []config.ScriptStep{share, read}}}, "step 0.0 of script test uses capture docs before any step captures it"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Prepare([]*config.Script{{Name: "test", Weight: 1, Steps: tt.steps}})
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+		})
+	}
+}
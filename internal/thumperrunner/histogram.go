@@ -0,0 +1,129 @@
+package thumperrunner
+
+import (
+	"math"
+	"math/bits"
+	"time"
+
+	"github.com/ccoveille/go-safecast"
+)
+
+// subBucketBits sets the precision of the histogram: values are tracked
+// exactly below 2^subBucketBits and with a relative error of at most
+// 2^-(subBucketBits-1) above it.
+const (
+	subBucketBits  = 7
+	subBucketCount = 1 << subBucketBits
+	subBucketHalf  = subBucketCount / 2
+)
+
+// histogram is a log-linear latency histogram in the style of HdrHistogram.
+// It records durations with microsecond resolution in constant memory per
+// order of magnitude. It is not safe for concurrent use.
+type histogram struct {
+	counts  []uint64
+	total   uint64
+	sum     time.Duration
+	lowest  time.Duration
+	highest time.Duration
+}
+
+func bucketIndex(value uint64) int {
+	if value < subBucketCount {
+		return int(value)
+	}
+
+	exponent := bits.Len64(value) - subBucketBits
+	return subBucketCount + (exponent-1)*subBucketHalf + int(value>>exponent) - subBucketHalf
+}
+
+// bucketLowest returns the lowest value that is recorded into the bucket.
+func bucketLowest(index int) uint64 {
+	if index < subBucketCount {
+		return uint64(index)
+	}
+
+	exponent := (index-subBucketCount)/subBucketHalf + 1
+	mantissa := (index-subBucketCount)%subBucketHalf + subBucketHalf
+	return uint64(mantissa) << exponent
+}
+
+func (h *histogram) record(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+
+	micros, _ := safecast.Convert[uint64](d.Microseconds())
+	index := bucketIndex(micros)
+	if index >= len(h.counts) {
+		grown := make([]uint64, index+1)
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	h.counts[index]++
+
+	if h.total == 0 || d < h.lowest {
+		h.lowest = d
+	}
+	if d > h.highest {
+		h.highest = d
+	}
+	h.total++
+	h.sum += d
+}
+
+// merge adds all values recorded in other to the histogram.
+func (h *histogram) merge(other *histogram) {
+	if other.total == 0 {
+		return
+	}
+
+	if len(other.counts) > len(h.counts) {
+		grown := make([]uint64, len(other.counts))
+		copy(grown, h.counts)
+		h.counts = grown
+	}
+	for index, count := range other.counts {
+		h.counts[index] += count
+	}
+
+	if h.total == 0 || other.lowest < h.lowest {
+		h.lowest = other.lowest
+	}
+	if other.highest > h.highest {
+		h.highest = other.highest
+	}
+	h.total += other.total
+	h.sum += other.sum
+}
+
+// quantile returns the value at or below which the given fraction of the
+// recorded values fall, rounded up to the end of its bucket.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(h.total)))
+	if target == 0 {
+		target = 1
+	}
+
+	var seen uint64
+	for index, count := range h.counts {
+		seen += count
+		if seen >= target {
+			upper := time.Duration(bucketLowest(index+1)-1) * time.Microsecond
+			return min(upper, h.highest)
+		}
+	}
+
+	return h.highest
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.total)
+}
@@ -0,0 +1,67 @@
+package thumperrunner
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucketIndex(t *testing.T) {
+	for _, value := range []uint64{0, 1, 127, 128, 129, 255, 256, 1000, 123456, 3_600_000_000} {
+		t.Run(strconv.FormatUint(value, 10), func(t *testing.T) {
+			index := bucketIndex(value)
+			require.LessOrEqual(t, bucketLowest(index), value)
+			require.Greater(t, bucketLowest(index+1), value)
+
+			// The width of a bucket never exceeds the configured precision.
+			width := bucketLowest(index+1) - bucketLowest(index)
+			require.LessOrEqual(t, float64(width), max(1, float64(value)/subBucketHalf))
+		})
+	}
+}
+
+func TestHistogramQuantile(t *testing.T) {
+	var h histogram
+	for i := 1; i <= 1000; i++ {
+		h.record(time.Duration(i) * time.Millisecond)
+	}
+
+	require.Equal(t, uint64(1000), h.total)
+	require.Equal(t, time.Millisecond, h.lowest)
+	require.Equal(t, time.Second, h.highest)
+	require.Equal(t, 500500*time.Microsecond, h.mean())
+
+	testCases := []struct {
+		quantile float64
+		expected time.Duration
+	}{
+		{0, time.Millisecond},
+		{.5, 500 * time.Millisecond},
+		{.9, 900 * time.Millisecond},
+		{.99, 990 * time.Millisecond},
+		{1, time.Second},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strconv.FormatFloat(tc.quantile, 'f', -1, 64), func(t *testing.T) {
+			actual := h.quantile(tc.quantile)
+			require.GreaterOrEqual(t, actual, tc.expected)
+			require.InEpsilon(t, tc.expected, actual, 1.0/subBucketHalf)
+		})
+	}
+}
+
+func TestHistogramMerge(t *testing.T) {
+	var a, b histogram
+	a.record(time.Millisecond)
+	b.record(time.Second)
+	b.record(2 * time.Second)
+
+	a.merge(&b)
+	require.Equal(t, uint64(3), a.total)
+	require.Equal(t, time.Millisecond, a.lowest)
+	require.Equal(t, 2*time.Second, a.highest)
+	require.InEpsilon(t, time.Millisecond, a.quantile(.3), 1.0/subBucketHalf)
+}
@@ -0,0 +1,97 @@
+package thumperrunner
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/ccoveille/go-safecast"
+	"github.com/rs/zerolog/log"
+)
+
+// RunLimits bound the length of a run. Zero values mean no limit.
+type RunLimits struct {
+	// Duration is the wall-clock time after which no new steps are issued.
+	Duration time.Duration
+
+	// Requests is the total number of steps issued across all workers.
+	Requests int
+
+	// Iterations limits the number of full passes made over each script.
+	Iterations *IterationBudget
+
+	// DrainTimeout bounds how long steps that are in flight when the run
+	// stops are given to finish before they are cancelled. Zero waits for
+	// as long as they take.
+	DrainTimeout time.Duration
+}
+
+// drain waits until finished is closed, cancelling the in-flight steps once
+// the drain timeout has passed.
+func (l RunLimits) drain(finished <-chan struct{}, cancelSteps context.CancelFunc) {
+	defer cancelSteps()
+
+	if l.DrainTimeout > 0 {
+		timer := time.NewTimer(l.DrainTimeout)
+		defer timer.Stop()
+
+		select {
+		case <-finished:
+			return
+		case <-timer.C:
+			log.Warn().Dur("drain-timeout", l.DrainTimeout).Msg("drain timeout reached, cancelling in-flight steps")
+			cancelSteps()
+		}
+	}
+
+	<-finished
+}
+
+// IterationBudget tracks how many steps of each script are left to run in
+// order to make a given number of full passes over it, counted across all
+// workers. Scripts are identified by their position in the list of scripts,
+// which is the same for every worker.
+type IterationBudget struct {
+	remaining []atomic.Int64
+}
+
+// NewIterationBudget creates a budget of the given number of passes over each
+// of the scripts. Scripts with a weight of zero and no rate of their own are
+// never picked, and so get no budget.
+func NewIterationBudget(scripts []*ExecutableScript, iterations int) *IterationBudget {
+	budget := &IterationBudget{remaining: make([]atomic.Int64, len(scripts))}
+	for index, script := range scripts {
+		if script.weight == 0 && script.qps == 0 {
+			continue
+		}
+
+		steps, _ := safecast.Convert[int64](iterations * len(script.steps))
+		budget.remaining[index].Store(steps)
+	}
+	return budget
+}
+
+// take reserves the given number of steps of the script at the given index,
+// returning false if its budget is used up.
+func (b *IterationBudget) take(script, steps int) bool {
+	if b.remaining[script].Add(int64(-steps)) >= 0 {
+		return true
+	}
+
+	b.remaining[script].Store(0)
+	return false
+}
+
+func (b *IterationBudget) available(script int) bool {
+	return b.remaining[script].Load() > 0
+}
+
+// Exhausted returns true once every script has run its passes.
+func (b *IterationBudget) Exhausted() bool {
+	for index := range b.remaining {
+		if b.available(index) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package thumperrunner
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/ccoveille/go-safecast"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+var pageServiceTimeHistogram = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "thumper",
+	Name:      "step_page_service_time_seconds",
+	Help:      "Time from requesting a page of a paginated script step until all of it was received.",
+	Buckets:   LatencyBuckets,
+}, []string{"op"})
+
+// pagination is how a LookupResources or ReadRelationships step pages
+// through its results. A nil pagination makes a single call for all of them.
+type pagination struct {
+	pageSize uint32
+
+	// all follows the cursors until the results are exhausted, rather than
+	// stopping after the first page.
+	all bool
+}
+
+// preparePagination returns the pagination of a step, or nil if it does not
+// paginate.
+func preparePagination(step config.ScriptStep) (*pagination, error) {
+	if step.PageSize == 0 {
+		if step.Paginate != "" {
+			return nil, errors.New("paginate requires a pageSize")
+		}
+		return nil, nil
+	}
+
+	pageSize, err := safecast.Convert[uint32](step.PageSize)
+	if err != nil {
+		return nil, fmt.Errorf("pageSize is too large: %w", err)
+	}
+
+	p := &pagination{pageSize: pageSize}
+	switch step.Paginate {
+	case "", "all":
+		p.all = true
+	case "first":
+	default:
+		return nil, fmt.Errorf("unknown paginate: %s", step.Paginate)
+	}
+	return p, nil
+}
+
+// limit is the limit to set on the requests of the step.
+func (p *pagination) limit() uint32 {
+	if p == nil {
+		return 0
+	}
+	return p.pageSize
+}
+
+// receiver returns a function that receives the messages of every page into
+// msg, for verifyAndCapture. open starts the call for the page after the given
+// cursor, which is nil for the first page, and cursor returns the cursor after
+// the message last received. A page with fewer results than the page size is
+// the last one.
+func (p *pagination) receiver(op string, msg proto.Message, errMsg string, open func(*v1.Cursor) (grpc.ClientStream, error), cursor func() *v1.Cursor) func(each func()) error {
+	return func(each func()) error {
+		var after *v1.Cursor
+		for {
+			start := time.Now()
+			stream, err := open(after)
+			if err != nil {
+				return err
+			}
+
+			var received uint32
+			if err := receiveStream(stream, msg, errMsg, func() {
+				received++
+				after = cursor()
+				each()
+			}); err != nil {
+				return err
+			}
+
+			if p == nil {
+				return nil
+			}
+			pageServiceTimeHistogram.WithLabelValues(op).Observe(time.Since(start).Seconds())
+			if !p.all || received != p.pageSize || after == nil {
+				return nil
+			}
+		}
+	}
+}
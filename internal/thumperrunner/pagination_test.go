@@ -0,0 +1,98 @@
+package thumperrunner
+
+import (
+	"context"
+	"testing"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupResourcesPagination(t *testing.T) {
+	resources := []string{"doc1", "doc2", "doc3", "doc4", "doc5"}
+
+	tests := []struct {
+		name          string
+		step          config.ScriptStep
+		expectedCalls int64
+		expectedErr   string
+	}{
+		{"unpaginated", config.ScriptStep{NumExpected: 5}, 1, ""},
+		{"all pages", config.ScriptStep{PageSize: 2, NumExpected: 5}, 3, ""},
+		{"explicitly all pages", config.ScriptStep{PageSize: 2, Paginate: "all", NumExpected: 5}, 3, ""},
+		{"last page is empty", config.ScriptStep{PageSize: 5, NumExpected: 5}, 2, ""},
+		{"single page", config.ScriptStep{PageSize: 10, NumExpected: 5}, 1, ""},
+		{"first page", config.ScriptStep{PageSize: 2, Paginate: "first", NumExpected: 2}, 1, ""},
+		{"expected resources", config.ScriptStep{PageSize: 2, ExpectedResources: resources}, 3, ""},
+		{"summed count", config.ScriptStep{PageSize: 2, NumExpected: 4}, 3, "LookupResources error: wrong number of stream objects received 4 != 5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakePermissions{resources: resources}
+			client := startFakeServer(t, fake)
+
+			tt.step.Op = "LookupResources"
+			tt.step.Resource = "document"
+			tt.step.Permission = "view"
+			tt.step.Subject = "user:tom"
+			step, err := prepareStep(tt.step)
+			require.NoError(t, err)
+
+			_, err = step.body(context.Background(), client, nil, newBindings(NewRand(1)))
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, tt.expectedErr)
+			}
+			require.Equal(t, tt.expectedCalls, fake.streamed.Load())
+		})
+	}
+}
+
+func TestReadRelationshipsPagination(t *testing.T) {
+	var relationships []*v1.Relationship
+	var expected []config.Relationship
+	for _, id := range []string{"doc1", "doc2", "doc3"} {
+		relationship, err := parseDescribedRelationship("document:" + id + "#viewer@user:tom")
+		require.NoError(t, err)
+		relationships = append(relationships, relationship)
+		expected = append(expected, config.Relationship{Resource: "document:" + id, Relation: "viewer", Subject: "user:tom"})
+	}
+	fake := &fakePermissions{relationships: relationships}
+	client := startFakeServer(t, fake)
+
+	step, err := prepareStep(config.ScriptStep{
+		Op:                    "ReadRelationships",
+		Resource:              "document",
+		PageSize:              2,
+		ExpectedRelationships: expected,
+		Capture:               "docs",
+	})
+	require.NoError(t, err)
+
+	b := newBindings(NewRand(1))
+	_, err = step.body(context.Background(), client, nil, b)
+	require.NoError(t, err)
+	require.Equal(t, int64(2), fake.streamed.Load())
+	require.Len(t, b.captured["docs"].results, 3)
+}
+
+func TestPreparePagination(t *testing.T) {
+	tests := []struct {
+		name        string
+		step        config.ScriptStep
+		expectedErr string
+	}{
+		{"paginate without page size", config.ScriptStep{Op: "ReadRelationships", Resource: "document", Paginate: "all"}, "error preparing ReadRelationships pagination: paginate requires a pageSize"},
+		{"unknown paginate", config.ScriptStep{Op: "LookupResources", Resource: "document", Permission: "view", Subject: "user:tom", PageSize: 2, Paginate: "some"}, "error preparing LookupResources pagination: unknown paginate: some"},
+		{"other op", config.ScriptStep{Op: "LookupSubjects", Resource: "document:readme", Permission: "view", Subject: "user", PageSize: 2}, "LookupSubjects steps cannot paginate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := prepareStep(tt.step)
+			require.EqualError(t, err, tt.expectedErr)
+		})
+	}
+}
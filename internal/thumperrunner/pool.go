@@ -0,0 +1,43 @@
+package thumperrunner
+
+import (
+	"errors"
+	"sync/atomic"
+
+	"github.com/authzed/authzed-go/v1"
+)
+
+// ClientPool hands out a fixed set of clients in round-robin order, so that
+// any number of workers can share a small number of connections.
+type ClientPool struct {
+	clients []*authzed.Client
+	next    atomic.Uint64
+}
+
+// NewClientPool creates a pool over the given clients, which must not be empty.
+func NewClientPool(clients ...*authzed.Client) *ClientPool {
+	if len(clients) == 0 {
+		panic("client pool requires at least one client")
+	}
+	return &ClientPool{clients: clients}
+}
+
+// Next returns the client that should be used for the next request.
+func (p *ClientPool) Next() *authzed.Client {
+	index := p.next.Add(1) - 1
+	return p.clients[index%uint64(len(p.clients))]
+}
+
+// Len returns the number of clients in the pool.
+func (p *ClientPool) Len() int {
+	return len(p.clients)
+}
+
+// Close closes every client in the pool.
+func (p *ClientPool) Close() error {
+	var errs []error
+	for _, client := range p.clients {
+		errs = append(errs, client.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,18 @@
+package thumperrunner
+
+import (
+	"testing"
+
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientPoolRoundRobin(t *testing.T) {
+	clients := []*authzed.Client{{}, {}, {}}
+	pool := NewClientPool(clients...)
+	require.Equal(t, 3, pool.Len())
+
+	for i := 0; i < 7; i++ {
+		require.Same(t, clients[i%3], pool.Next())
+	}
+}
@@ -5,55 +5,283 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"math/rand"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/authzed/internal/thumper/internal/config"
 
 	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
 	"github.com/authzed/authzed-go/v1"
+	"github.com/ccoveille/go-safecast"
+	"github.com/mroth/weightedrand"
 	"github.com/rs/zerolog/log"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 // Prepare transforms a loaded yaml script into one that can be efficiently executed.
 func Prepare(inputs []*config.Script) (prepared []*ExecutableScript, err error) {
 	for _, input := range inputs {
-		steps := make([]executableStep, 0, len(input.Steps))
+		var session bool
+		switch input.Mode {
+		case "", "step":
+		case "session":
+			session = true
+		default:
+			return prepared, fmt.Errorf("unknown mode for script %s: %s", input.Name, input.Mode)
+		}
+
+		var steps []executableStep
+		steps, err = prepareSteps(input.Name, "", input.Steps, make(map[string]bool))
+		if err != nil {
+			return prepared, err
+		}
+
+		prepared = append(prepared, &ExecutableScript{
+			name:            input.Name,
+			weight:          input.Weight,
+			qps:             input.QPS,
+			steps:           steps,
+			session:         session,
+			followsPrevious: followsPrevious(input.Steps),
+		})
+	}
 
-		for _, rawStep := range input.Steps {
-			var step executableStep
+	return prepared, err
+}
+
+// prepareSteps prepares the given steps of a script, and the steps nested in
+// them. Steps are named by their index, prefixed by the name of the step they
+// are nested in. Captured holds the names of the captures of the steps before
+// them, and is updated with the captures of the given steps.
+func prepareSteps(script, prefix string, rawSteps []config.ScriptStep, captured map[string]bool) ([]executableStep, error) {
+	steps := make([]executableStep, 0, len(rawSteps))
+	for index, rawStep := range rawSteps {
+		name := prefix + strconv.Itoa(index)
+
+		for _, capture := range stepCaptureReferences(rawStep) {
+			if !captured[capture] {
+				return nil, fmt.Errorf("step %s of script %s uses capture %s before any step captures it", name, script, capture)
+			}
+		}
+
+		var step executableStep
+		var err error
+		if rawStep.Op == "" {
+			step, err = prepareFlow(script, name, rawStep, captured)
+		} else {
 			step, err = prepareStep(rawStep)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if rawStep.Capture != "" {
+			captured[rawStep.Capture] = true
+		}
+
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// followsPrevious returns whether any of the given steps, or the steps nested
+// in them, has an if on the outcome of the previous step.
+func followsPrevious(steps []config.ScriptStep) bool {
+	for _, step := range steps {
+		if step.If != nil && step.If.Previous != "" {
+			return true
+		}
+		if followsPrevious(step.Steps) || followsPrevious(step.Else) {
+			return true
+		}
+		for _, branch := range step.Choose {
+			if followsPrevious(branch.Steps) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareFlow prepares a step without an op, which runs the steps nested in it
+// depending on its repeat, choose, or if. Each branch of a choose or if is
+// prepared with its own copy of captured, and only the captures of every
+// branch are added to it afterwards.
+func prepareFlow(script, name string, step config.ScriptStep, captured map[string]bool) (executableStep, error) {
+	var kinds int
+	for _, set := range []bool{step.Repeat > 0, len(step.Choose) > 0, step.If != nil} {
+		if set {
+			kinds++
+		}
+	}
+	switch {
+	case kinds != 1:
+		return executableStep{}, fmt.Errorf("step %s of script %s must have an op, or exactly one of repeat, choose, or if", name, script)
+	case step.ExpectError != nil:
+		return executableStep{}, fmt.Errorf("step %s of script %s has no op to expect an error from", name, script)
+	case step.If == nil && len(step.Else) > 0:
+		return executableStep{}, fmt.Errorf("step %s of script %s has else steps without an if", name, script)
+	case len(step.Choose) == 0 && len(step.Steps) == 0:
+		return executableStep{}, fmt.Errorf("step %s of script %s has no steps", name, script)
+	}
+
+	flow := &controlFlow{repeat: step.Repeat}
+	switch {
+	case len(step.Choose) > 0:
+		if len(step.Steps) > 0 {
+			return executableStep{}, fmt.Errorf("step %s of script %s has steps outside of the branches of its choose", name, script)
+		}
+
+		choices := make([]weightedrand.Choice, 0, len(step.Choose))
+		branchCaptures := make([]map[string]bool, 0, len(step.Choose))
+		for index, branch := range step.Choose {
+			branchName := fmt.Sprintf("%s.choose%d", name, index)
+			if len(branch.Steps) == 0 {
+				return executableStep{}, fmt.Errorf("step %s of script %s has no steps", branchName, script)
+			}
+
+			branchCaptured := maps.Clone(captured)
+			steps, err := prepareSteps(script, branchName+".", branch.Steps, branchCaptured)
 			if err != nil {
-				return prepared, err
+				return executableStep{}, err
 			}
+			choices = append(choices, weightedrand.NewChoice(steps, branch.Weight))
+			branchCaptures = append(branchCaptures, branchCaptured)
+		}
+		captureEvery(captured, branchCaptures)
 
-			steps = append(steps, step)
+		branches, err := weightedrand.NewChooser(choices...)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing the branches of step %s of script %s: %w", name, script, err)
+		}
+		flow.branches = branches
+	case step.If != nil:
+		if (step.If.Captured == "") == (step.If.Previous == "") {
+			return executableStep{}, fmt.Errorf("the if of step %s of script %s must have exactly one of captured or previous", name, script)
+		}
+		switch step.If.Previous {
+		case "", "succeeded", "failed":
+		default:
+			return executableStep{}, fmt.Errorf("unknown previous outcome in the if of step %s of script %s: %s", name, script, step.If.Previous)
+		}
+		if step.If.Captured != "" && !captured[step.If.Captured] {
+			return executableStep{}, fmt.Errorf("step %s of script %s uses capture %s before any step captures it", name, script, step.If.Captured)
 		}
 
-		prepared = append(prepared, &ExecutableScript{
-			name:   input.Name,
-			weight: input.Weight,
-			steps:  steps,
-		})
+		flow.condition = &condition{
+			captured: step.If.Captured,
+			previous: step.If.Previous,
+			not:      step.If.Not,
+		}
+
+		thenCaptured, elseCaptured := maps.Clone(captured), maps.Clone(captured)
+		steps, err := prepareSteps(script, name+".", step.Steps, thenCaptured)
+		if err != nil {
+			return executableStep{}, err
+		}
+		flow.steps = steps
+
+		otherwise, err := prepareSteps(script, name+".else.", step.Else, elseCaptured)
+		if err != nil {
+			return executableStep{}, err
+		}
+		flow.otherwise = otherwise
+		captureEvery(captured, []map[string]bool{thenCaptured, elseCaptured})
+	default:
+		// The steps of a repeat always run at least once.
+		steps, err := prepareSteps(script, name+".", step.Steps, captured)
+		if err != nil {
+			return executableStep{}, err
+		}
+		flow.steps = steps
 	}
 
-	return prepared, err
+	return executableStep{flow: flow}, nil
+}
+
+// captureEvery adds the names in the captures of every one of the branches to
+// captured, since only those are captured whichever branch runs.
+func captureEvery(captured map[string]bool, branches []map[string]bool) {
+	for name := range branches[0] {
+		every := true
+		for _, branch := range branches[1:] {
+			every = every && branch[name]
+		}
+		if every {
+			captured[name] = true
+		}
+	}
 }
 
 func prepareStep(step config.ScriptStep) (executableStep, error) {
+	if step.Repeat > 0 || len(step.Choose) > 0 || step.If != nil || len(step.Steps) > 0 || len(step.Else) > 0 {
+		return executableStep{}, fmt.Errorf("%s steps cannot have control flow", step.Op)
+	}
+
 	consistencyForZedToken, consistencyDesc, err := prepareConsistency(step)
 	if err != nil {
 		return executableStep{}, fmt.Errorf("error preparing consistency: %w", err)
 	}
 
 	execStep := executableStep{
-		op:          step.Op,
-		consistency: consistencyDesc,
+		op:              step.Op,
+		consistency:     consistencyDesc,
+		continueOnError: step.ContinueOnError,
 	}
 
 	switch step.Op {
+	case "LookupResources", "LookupSubjects", "ReadRelationships":
+	default:
+		if step.Capture != "" {
+			return executableStep{}, fmt.Errorf("%s steps cannot capture their results", step.Op)
+		}
+	}
+	if step.ExpectedResources != nil && step.Op != "LookupResources" {
+		return executableStep{}, fmt.Errorf("%s steps cannot expect resources", step.Op)
+	}
+	if step.ExpectedSubjects != nil && step.Op != "LookupSubjects" {
+		return executableStep{}, fmt.Errorf("%s steps cannot expect subjects", step.Op)
+	}
+	if step.ExpectTree != nil && step.Op != "ExpandPermissionTree" {
+		return executableStep{}, fmt.Errorf("%s steps cannot expect a tree", step.Op)
+	}
+	if step.ExpectedRelationships != nil && step.Op != "ReadRelationships" {
+		return executableStep{}, fmt.Errorf("%s steps cannot expect relationships", step.Op)
+	}
+	switch step.Op {
+	case "LookupResources", "ReadRelationships":
+	default:
+		if step.PageSize > 0 || step.Paginate != "" {
+			return executableStep{}, fmt.Errorf("%s steps cannot paginate", step.Op)
+		}
+	}
+	switch step.Op {
+	case "ImportBulkRelationships":
+	case "ExportBulkRelationships":
+		if len(step.Relationships) > 0 || step.Count > 0 {
+			return executableStep{}, fmt.Errorf("%s steps cannot load relationships", step.Op)
+		}
+	default:
+		if len(step.Relationships) > 0 || step.Count > 0 || step.File != "" || step.BatchSize > 0 {
+			return executableStep{}, fmt.Errorf("%s steps cannot load or export relationships", step.Op)
+		}
+	}
+
+	switch step.Op {
+	case "Sleep":
+		sleep, err := prepareSleep(step)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing Sleep: %w", err)
+		}
+		execStep.sleep = sleep
 	case "CheckPermission":
 		res, err := parseObject(step.Resource)
 		if err != nil {
@@ -65,12 +293,16 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			return executableStep{}, fmt.Errorf("error parsing CheckPermission subject: %w", err)
 		}
 
-		req := &v1.CheckPermissionRequest{
+		request, err := prepareRequest(&v1.CheckPermissionRequest{
 			Resource:   res,
 			Subject:    sub,
 			Permission: step.Permission,
 			Context:    (*structpb.Struct)(step.Context),
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing CheckPermission: %w", err)
 		}
+
 		expected := v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION
 		if step.ExpectNoPermission {
 			expected = v1.CheckPermissionResponse_PERMISSIONSHIP_NO_PERMISSION
@@ -85,10 +317,14 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			expected = v1.CheckPermissionResponse_PERMISSIONSHIP_CONDITIONAL_PERMISSION
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
-			req.Consistency = consistencyForZedToken(zt)
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
+			if err != nil {
+				return nil, err
+			}
+			call.Consistency = consistencyForZedToken(zt)
 
-			resp, err := client.CheckPermission(ctx, req)
+			resp, err := client.CheckPermission(ctx, call)
 			if err != nil {
 				return nil, err
 			}
@@ -96,9 +332,9 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			if resp.Permissionship != expected {
 				return nil, fmt.Errorf(
 					"CheckPermission returned wrong permissionship: %s#%s@%s => %s",
-					step.Resource,
+					b.describe(step.Resource),
 					step.Permission,
-					step.Subject,
+					b.describe(step.Subject),
 					resp.Permissionship,
 				)
 			}
@@ -111,18 +347,52 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			return executableStep{}, fmt.Errorf("error parsing ReadRealtionships filter: %w", err)
 		}
 
-		req := &v1.ReadRelationshipsRequest{
+		pages, err := preparePagination(step)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ReadRelationships pagination: %w", err)
+		}
+
+		request, err := prepareRequest(&v1.ReadRelationshipsRequest{
 			RelationshipFilter: filter,
+			OptionalLimit:      pages.limit(),
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ReadRelationships: %w", err)
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
-			req.Consistency = consistencyForZedToken(zt)
-			resp, err := client.ReadRelationships(ctx, req)
+		relationships, err := describeExpectedRelationships(step.ExpectedRelationships)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error parsing ReadRelationships expectedRelationships: %w", err)
+		}
+		expected, err := prepareExpectedResults(step, relationships, nil)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ReadRelationships expectedRelationships: %w", err)
+		}
+
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
 			if err != nil {
 				return nil, err
 			}
-
-			return zt, verifyExpectedStreamCount(resp, &v1.ReadRelationshipsResponse{}, step.NumExpected, "ReadRelationships error: %w")
+			call.Consistency = consistencyForZedToken(zt)
+
+			msg := &v1.ReadRelationshipsResponse{}
+			receive := pages.receiver(step.Op, msg, "ReadRelationships error: %w", func(cursor *v1.Cursor) (grpc.ClientStream, error) {
+				call.OptionalCursor = cursor
+				return client.ReadRelationships(ctx, call)
+			}, func() *v1.Cursor { return msg.AfterResultCursor })
+			return zt, verifyAndCapture(receive, step, expected, b, "ReadRelationships error: %w", func() streamResult {
+				relationship := msg.Relationship
+				return streamResult{
+					fields: map[string]string{
+						"":         relationship.Resource.ObjectId,
+						"resource": relationship.Resource.ObjectId,
+						"relation": relationship.Relation,
+						"subject":  relationship.Subject.Object.ObjectId,
+					},
+					description: describeRelationship(relationship),
+				}
+			})
 		}
 	case "DeleteRelationships":
 		filter, err := parseRelationshipFilter(step.Resource, step.Permission, step.Subject)
@@ -130,12 +400,20 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			return executableStep{}, fmt.Errorf("error parsing DeleteRelationships filter: %w", err)
 		}
 
-		req := &v1.DeleteRelationshipsRequest{
+		request, err := prepareRequest(&v1.DeleteRelationshipsRequest{
 			RelationshipFilter: filter,
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing DeleteRelationships: %w", err)
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, _ *v1.ZedToken) (*v1.ZedToken, error) {
-			resp, err := client.DeleteRelationships(ctx, req)
+		execStep.body = func(ctx context.Context, client *authzed.Client, _ *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := client.DeleteRelationships(ctx, call)
 			if err != nil {
 				return nil, err
 			}
@@ -147,17 +425,40 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 		if err != nil {
 			return executableStep{}, fmt.Errorf("error parsing ExpandPermissionTree resource: %w", err)
 		}
-		req := &v1.ExpandPermissionTreeRequest{
+		request, err := prepareRequest(&v1.ExpandPermissionTreeRequest{
 			Resource:   res,
 			Permission: step.Permission,
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ExpandPermissionTree: %w", err)
+		}
+
+		expected, err := prepareTreeExpectations(step.ExpectTree)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ExpandPermissionTree expectTree: %w", err)
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
-			req.Consistency = consistencyForZedToken(zt)
-			resp, err := client.ExpandPermissionTree(ctx, req)
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
 			if err != nil {
 				return nil, err
 			}
+			call.Consistency = consistencyForZedToken(zt)
+			resp, err := client.ExpandPermissionTree(ctx, call)
+			if err != nil {
+				return nil, err
+			}
+
+			if expected != nil {
+				if err := expected.verify(b, resp.TreeRoot); err != nil {
+					return nil, fmt.Errorf(
+						"ExpandPermissionTree returned an unexpected tree for %s#%s: %w",
+						b.describe(step.Resource),
+						step.Permission,
+						err,
+					)
+				}
+			}
 
 			return resp.ExpandedAt, nil
 		}
@@ -167,21 +468,49 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			return executableStep{}, fmt.Errorf("error parsing LookupResources subject: %w", err)
 		}
 
-		req := &v1.LookupResourcesRequest{
+		pages, err := preparePagination(step)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing LookupResources pagination: %w", err)
+		}
+
+		request, err := prepareRequest(&v1.LookupResourcesRequest{
 			ResourceObjectType: step.Resource,
 			Permission:         step.Permission,
 			Subject:            sub,
 			Context:            (*structpb.Struct)(step.Context),
+			OptionalLimit:      pages.limit(),
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing LookupResources: %w", err)
+		}
+
+		expected, err := prepareExpectedResults(step, step.ExpectedResources, canonicalResult)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing LookupResources expectedResources: %w", err)
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
-			req.Consistency = consistencyForZedToken(zt)
-			resp, err := client.LookupResources(ctx, req)
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
 			if err != nil {
 				return nil, err
 			}
-
-			return zt, verifyExpectedStreamCount(resp, &v1.LookupResourcesResponse{}, step.NumExpected, "LookupResources error: %w")
+			call.Consistency = consistencyForZedToken(zt)
+
+			msg := &v1.LookupResourcesResponse{}
+			receive := pages.receiver(step.Op, msg, "LookupResources error: %w", func(cursor *v1.Cursor) (grpc.ClientStream, error) {
+				call.OptionalCursor = cursor
+				return client.LookupResources(ctx, call)
+			}, func() *v1.Cursor { return msg.AfterResultCursor })
+			return zt, verifyAndCapture(receive, step, expected, b, "LookupResources error: %w", func() streamResult {
+				return streamResult{
+					fields: map[string]string{"": msg.ResourceObjectId, "resource": msg.ResourceObjectId},
+					description: describeResult(
+						msg.ResourceObjectId,
+						nil,
+						msg.Permissionship == v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION,
+					),
+				}
+			})
 		}
 	case "LookupSubjects":
 		res, err := parseObject(step.Resource)
@@ -189,44 +518,103 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			return executableStep{}, fmt.Errorf("error parsing CheckPermission resource: %w", err)
 		}
 
-		req := &v1.LookupSubjectsRequest{
+		request, err := prepareRequest(&v1.LookupSubjectsRequest{
 			SubjectObjectType: step.Subject,
 			Resource:          res,
 			Permission:        step.Permission,
 			Context:           (*structpb.Struct)(step.Context),
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing LookupSubjects: %w", err)
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
-			req.Consistency = consistencyForZedToken(zt)
-			resp, err := client.LookupSubjects(ctx, req)
+		expected, err := prepareExpectedResults(step, step.ExpectedSubjects, canonicalResult)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing LookupSubjects expectedSubjects: %w", err)
+		}
+
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
+			if err != nil {
+				return nil, err
+			}
+			call.Consistency = consistencyForZedToken(zt)
+			resp, err := client.LookupSubjects(ctx, call)
 			if err != nil {
 				return nil, err
 			}
 
-			return zt, verifyExpectedStreamCount(resp, &v1.LookupSubjectsResponse{}, step.NumExpected, "LookupResources error: %w")
+			msg := &v1.LookupSubjectsResponse{}
+			return zt, verifyAndCapture(streamReceiver(resp, msg, "LookupSubjects error: %w"), step, expected, b, "LookupSubjects error: %w", func() streamResult {
+				subjectID := msg.Subject.GetSubjectObjectId()
+				excluded := make([]string, 0, len(msg.ExcludedSubjects))
+				for _, subject := range msg.ExcludedSubjects {
+					excluded = append(excluded, subject.SubjectObjectId)
+				}
+				return streamResult{
+					fields: map[string]string{"": subjectID, "subject": subjectID},
+					description: describeResult(
+						subjectID,
+						excluded,
+						msg.Subject.GetPermissionship() == v1.LookupPermissionship_LOOKUP_PERMISSIONSHIP_CONDITIONAL_PERMISSION,
+					),
+				}
+			})
 		}
 	case "WriteRelationships":
 		updates, err := parseUpdates(step.Updates)
 		if err != nil {
 			return executableStep{}, fmt.Errorf("error parsing WriteRelationships updates: %w", err)
 		}
-		req := &v1.WriteRelationshipsRequest{
+		request, err := prepareRequest(&v1.WriteRelationshipsRequest{
 			Updates: updates,
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing WriteRelationships: %w", err)
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, _ *v1.ZedToken) (*v1.ZedToken, error) {
-			resp, err := client.WriteRelationships(ctx, req)
+		execStep.body = func(ctx context.Context, client *authzed.Client, _ *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
+			if err != nil {
+				return nil, err
+			}
+
+			resp, err := client.WriteRelationships(ctx, call)
 			if err != nil {
 				return nil, err
 			}
 			return resp.WrittenAt, nil
 		}
+
+		// Placeholders keep their values for the rest of an iteration, so
+		// expanding the updates again gives those that were written.
+		execStep.updates = func(b *bindings) ([]*v1.RelationshipUpdate, error) {
+			call, err := request(b)
+			if err != nil {
+				return nil, err
+			}
+			return call.Updates, nil
+		}
+	case "ImportBulkRelationships":
+		body, err := prepareImport(step)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ImportBulkRelationships: %w", err)
+		}
+		execStep.body = body
+		execStep.timeout = bulkStepTimeout
+	case "ExportBulkRelationships":
+		body, err := prepareExport(step, consistencyForZedToken)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing ExportBulkRelationships: %w", err)
+		}
+		execStep.body = body
+		execStep.timeout = bulkStepTimeout
 	case "WriteSchema":
 		req := &v1.WriteSchemaRequest{
 			Schema: step.Schema,
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, _ *bindings) (*v1.ZedToken, error) {
 			_, err := client.WriteSchema(ctx, req)
 			if err != nil {
 				return nil, err
@@ -254,12 +642,20 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 			})
 		}
 
-		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken) (*v1.ZedToken, error) {
-			req := &v1.CheckBulkPermissionsRequest{
-				Consistency: consistencyForZedToken(zt),
-				Items:       items,
+		request, err := prepareRequest(&v1.CheckBulkPermissionsRequest{
+			Items: items,
+		})
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing CheckBulkPermissions: %w", err)
+		}
+
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			call, err := request(b)
+			if err != nil {
+				return nil, err
 			}
-			resp, err := client.CheckBulkPermissions(ctx, req)
+			call.Consistency = consistencyForZedToken(zt)
+			resp, err := client.CheckBulkPermissions(ctx, call)
 			if err != nil {
 				return nil, err
 			}
@@ -286,9 +682,9 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 				if permissionship := pair.GetItem().Permissionship; permissionship != expected {
 					return nil, fmt.Errorf(
 						"CheckBulkPermissions returned wrong permissionship: %s#%s@%s => %s",
-						check.Resource,
+						b.describe(check.Resource),
 						check.Permission,
-						check.Subject,
+						b.describe(check.Subject),
 						permissionship,
 					)
 				}
@@ -300,9 +696,92 @@ func prepareStep(step config.ScriptStep) (executableStep, error) {
 		return executableStep{}, fmt.Errorf("unknown script step operation: %s", step.Op)
 	}
 
+	if step.ExpectError != nil {
+		if execStep.sleep != nil {
+			return executableStep{}, fmt.Errorf("%s steps cannot expect errors", step.Op)
+		}
+
+		check, err := prepareExpectedError(step.Op, step.ExpectError)
+		if err != nil {
+			return executableStep{}, fmt.Errorf("error preparing expectError: %w", err)
+		}
+
+		// The step only succeeds when its call failed, in which case nothing
+		// was written for the watcher to wait for.
+		execStep.updates = nil
+
+		body := execStep.body
+		execStep.body = func(ctx context.Context, client *authzed.Client, zt *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			// A failed call has no token of its own, so the token it was
+			// given is passed on to the next step.
+			_, err := body(ctx, client, zt, b)
+			return zt, check(err)
+		}
+	}
+
 	return execStep, nil
 }
 
+// prepareExpectedError returns a function that checks the error of a step
+// that is expected to fail, returning nil if it failed as expected, and an
+// error describing the difference otherwise. Only errors returned by the
+// server, which carry a gRPC status, are expected, rather than those of the
+// checks thumper makes on the results.
+func prepareExpectedError(op string, expected *config.ExpectedError) (func(error) error, error) {
+	if expected.Code == "" && expected.MessageContains == "" {
+		return nil, errors.New("either code or messageContains is required")
+	}
+
+	var code codes.Code
+	if expected.Code != "" {
+		if err := code.UnmarshalJSON([]byte(strconv.Quote(expected.Code))); err != nil {
+			return nil, fmt.Errorf("unknown error code: %s", expected.Code)
+		}
+	}
+
+	return func(err error) error {
+		if err == nil {
+			return fmt.Errorf("%s succeeded, but was expected to fail", op)
+		}
+
+		actual, ok := status.FromError(err)
+		if !ok {
+			return fmt.Errorf("%s failed without an error from the server: %w", op, err)
+		}
+		if expected.Code != "" && actual.Code() != code {
+			return fmt.Errorf("%s failed with %s, but was expected to fail with %s: %w", op, actual.Code(), code, err)
+		}
+		if !strings.Contains(err.Error(), expected.MessageContains) {
+			return fmt.Errorf("%s failed without %q in its error: %w", op, expected.MessageContains, err)
+		}
+		return nil
+	}, nil
+}
+
+// prepareSleep returns a function that draws how long a Sleep step waits.
+// Sleeps are drawn the same way as arrivals, with the duration as the mean.
+func prepareSleep(step config.ScriptStep) (func(*rand.Rand) time.Duration, error) {
+	if step.Duration <= 0 {
+		return nil, fmt.Errorf("duration must be positive, got %s", step.Duration)
+	}
+
+	var mode ArrivalMode
+	switch step.Distribution {
+	case "", "fixed":
+		mode = ArrivalFixed
+	case "uniform":
+		mode = ArrivalUniform
+	case "exponential":
+		mode = ArrivalPoisson
+	default:
+		return nil, fmt.Errorf("unknown distribution: %s", step.Distribution)
+	}
+
+	return func(rng *rand.Rand) time.Duration {
+		return time.Duration(mode.draw(rng) * float64(step.Duration))
+	}, nil
+}
+
 type consistencyFunc func(zt *v1.ZedToken) *v1.Consistency
 
 var fullConsistency = &v1.Consistency{
@@ -351,14 +830,188 @@ func prepareConsistency(step config.ScriptStep) (consistencyFunc, string, error)
 	}
 }
 
-func verifyExpectedStreamCount(stream grpc.ClientStream, msg proto.Message, numExpected uint, errMsg string) error {
-	var received uint
+// stepCaptureReferences returns the names of the captures the placeholders of
+// the step refer to.
+func stepCaptureReferences(step config.ScriptStep) []string {
+	fields := []string{step.Resource, step.Subject, step.Permission}
+	fields = append(fields, step.ExpectedResources...)
+	fields = append(fields, step.ExpectedSubjects...)
+	for _, relationship := range step.ExpectedRelationships {
+		fields = append(fields, relationship.Resource, relationship.Subject, relationship.Relation)
+	}
+	if step.ExpectTree != nil {
+		fields = append(fields, step.ExpectTree.Includes...)
+		fields = append(fields, step.ExpectTree.Excludes...)
+	}
+	for _, update := range step.Updates {
+		fields = append(fields, update.Resource, update.Subject, update.Relation)
+	}
+	for _, check := range step.Checks {
+		fields = append(fields, check.Resource, check.Subject, check.Permission)
+	}
+	for _, relationship := range step.Relationships {
+		fields = append(fields, relationship.Resource, relationship.Subject, relationship.Relation)
+	}
+
+	var names []string
+	for _, field := range fields {
+		names = append(names, capturedNames(field)...)
+	}
+	return names
+}
+
+// streamResult is a single message of a streaming step, as the fields it
+// captures and as it is compared to the expected results of the step.
+type streamResult struct {
+	fields      map[string]string
+	description string
+}
+
+// prepareExpectedResults returns the results a streaming step expects, which
+// replace the number of results it expects when they are set, or nil if the
+// step expects no results in particular.
+func prepareExpectedResults(step config.ScriptStep, results []string, canonical func(string) string) (*expectedResults, error) {
+	if results == nil {
+		if step.Match != "" {
+			return nil, errors.New("match requires expected results")
+		}
+		return nil, nil
+	}
+
+	var subset bool
+	switch step.Match {
+	case "", "exact":
+	case "subset":
+		subset = true
+	default:
+		return nil, fmt.Errorf("unknown match: %s", step.Match)
+	}
 
+	if step.NumExpected != 0 {
+		if subset {
+			return nil, errors.New("numExpected cannot be combined with a subset match")
+		}
+		if count, _ := safecast.Convert[uint](len(results)); count != step.NumExpected {
+			return nil, fmt.Errorf("numExpected is %d, but %d results are expected", step.NumExpected, len(results))
+		}
+	}
+
+	return &expectedResults{results: results, subset: subset, canonical: canonical}, nil
+}
+
+// describeExpectedRelationships describes the relationships a
+// ReadRelationships step expects the same way as those it reads.
+func describeExpectedRelationships(relationships []config.Relationship) ([]string, error) {
+	if relationships == nil {
+		return nil, nil
+	}
+
+	described := make([]string, 0, len(relationships))
+	for _, expected := range relationships {
+		relationship, err := parseRelationship(expected)
+		if err != nil {
+			return nil, err
+		}
+		described = append(described, describeRelationship(relationship))
+	}
+	return described, nil
+}
+
+func parseRelationship(relationship config.Relationship) (*v1.Relationship, error) {
+	res, err := parseObject(relationship.Resource)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing resource: %w", err)
+	}
+	sub, err := parseSubject(relationship.Subject)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing subject: %w", err)
+	}
+
+	parsed := &v1.Relationship{Resource: res, Relation: relationship.Relation, Subject: sub}
+	if relationship.Caveat != nil {
+		parsed.OptionalCaveat = &v1.ContextualizedCaveat{
+			CaveatName: relationship.Caveat.Name,
+			Context:    (*structpb.Struct)(relationship.Caveat.Context),
+		}
+	}
+	if relationship.Expiration != "" {
+		expiration, err := time.Parse(time.RFC3339, relationship.Expiration)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing expiration: %w", err)
+		}
+		parsed.OptionalExpiresAt = timestamppb.New(expiration)
+	}
+	return parsed, nil
+}
+
+// verifyAndCapture checks that the messages received by receive are the
+// expected results, or as many as expected if the step expects no results in
+// particular, and captures the fields of each of them if the step captures
+// its results.
+func verifyAndCapture(receive func(each func()) error, step config.ScriptStep, expected *expectedResults, b *bindings, errMsg string, result func() streamResult) error {
+	if step.Capture == "" && expected == nil {
+		return verifyExpectedStreamCount(receive, step.NumExpected, errMsg, nil)
+	}
+
+	var captured []map[string]string
+	var returned []string
+	each := func() {
+		r := result()
+		captured = append(captured, r.fields)
+		returned = append(returned, r.description)
+	}
+
+	if expected == nil {
+		if err := verifyExpectedStreamCount(receive, step.NumExpected, errMsg, each); err != nil {
+			return err
+		}
+	} else {
+		if err := receive(each); err != nil {
+			return err
+		}
+		if err := expected.verify(b, returned); err != nil {
+			return fmt.Errorf(errMsg, err)
+		}
+	}
+
+	if step.Capture != "" {
+		b.capture(step.Capture, captured)
+	}
+	return nil
+}
+
+// streamReceiver returns a function that receives every message of a single
+// stream, for verifyAndCapture.
+func streamReceiver(stream grpc.ClientStream, msg proto.Message, errMsg string) func(each func()) error {
+	return func(each func()) error {
+		return receiveStream(stream, msg, errMsg, each)
+	}
+}
+
+// receiveStream receives every message of the stream into msg, calling each
+// after every one of them.
+func receiveStream(stream grpc.ClientStream, msg proto.Message, errMsg string, each func()) error {
 	for err := stream.RecvMsg(msg); !errors.Is(err, io.EOF); err = stream.RecvMsg(msg) {
 		if err != nil {
 			return fmt.Errorf(errMsg, err)
 		}
+		each()
+	}
+	return nil
+}
+
+// verifyExpectedStreamCount receives every message with receive, calling
+// each after every one of them if it is set, and checks that there were as
+// many as expected.
+func verifyExpectedStreamCount(receive func(each func()) error, numExpected uint, errMsg string, each func()) error {
+	var received uint
+	if err := receive(func() {
+		if each != nil {
+			each()
+		}
 		received++
+	}); err != nil {
+		return err
 	}
 
 	if received != numExpected {
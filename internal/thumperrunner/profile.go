@@ -0,0 +1,146 @@
+package thumperrunner
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+)
+
+// RateProfile computes the target rate at any point of a run from a load
+// profile.
+type RateProfile struct {
+	stages []rateStage
+	repeat bool
+	total  time.Duration
+}
+
+type rateStage struct {
+	kind     string
+	duration time.Duration
+	rate     func(offset time.Duration) float64
+	endRate  float64
+}
+
+// NewRateProfile validates a load profile and compiles it into a RateProfile.
+// The initial rate is used until a stage sets a rate of its own.
+func NewRateProfile(profile *config.Profile, initialQPS float64) (*RateProfile, error) {
+	if len(profile.Stages) == 0 {
+		return nil, errors.New("load profile must have at least one stage")
+	}
+
+	compiled := &RateProfile{repeat: profile.Repeat}
+	previous := initialQPS
+	for index, stage := range profile.Stages {
+		if stage.Duration <= 0 {
+			return nil, fmt.Errorf("load profile stage %d: duration must be positive", index)
+		}
+
+		rs, err := compileStage(stage, previous)
+		if err != nil {
+			return nil, fmt.Errorf("load profile stage %d: %w", index, err)
+		}
+
+		compiled.stages = append(compiled.stages, rs)
+		compiled.total += stage.Duration
+		previous = rs.endRate
+	}
+
+	return compiled, nil
+}
+
+func compileStage(stage config.ProfileStage, previous float64) (rateStage, error) {
+	rs := rateStage{kind: stage.Type, duration: stage.Duration}
+
+	switch stage.Type {
+	case "ramp":
+		from := previous
+		if stage.From != nil {
+			from = *stage.From
+		}
+		if from < 0 || stage.To < 0 {
+			return rateStage{}, errors.New("ramp rates must not be negative")
+		}
+
+		to := stage.To
+		rs.rate = func(offset time.Duration) float64 {
+			return from + (to-from)*offset.Seconds()/stage.Duration.Seconds()
+		}
+		rs.endRate = to
+	case "hold":
+		rs.rate = func(time.Duration) float64 { return previous }
+		rs.endRate = previous
+	case "step", "spike":
+		if stage.QPS < 0 {
+			return rateStage{}, fmt.Errorf("%s rate must not be negative", stage.Type)
+		}
+
+		qps := stage.QPS
+		rs.rate = func(time.Duration) float64 { return qps }
+		rs.endRate = qps
+
+		// A spike returns to the rate it started from.
+		if stage.Type == "spike" {
+			rs.endRate = previous
+		}
+	case "sine":
+		if stage.Period <= 0 {
+			return rateStage{}, errors.New("sine period must be positive")
+		}
+		if stage.Amplitude < 0 || stage.Amplitude > stage.QPS {
+			return rateStage{}, errors.New("sine amplitude must be between 0 and the midpoint rate")
+		}
+
+		qps, amplitude, period := stage.QPS, stage.Amplitude, stage.Period
+		rs.rate = func(offset time.Duration) float64 {
+			return qps + amplitude*math.Sin(2*math.Pi*offset.Seconds()/period.Seconds())
+		}
+		rs.endRate = rs.rate(stage.Duration)
+	default:
+		return rateStage{}, fmt.Errorf("unknown stage type: %s", stage.Type)
+	}
+
+	return rs, nil
+}
+
+// Rate returns the target rate at the given time since the start of the run.
+func (p *RateProfile) Rate(elapsed time.Duration) float64 {
+	if p.repeat {
+		elapsed %= p.total
+	}
+
+	for _, stage := range p.stages {
+		if elapsed < stage.duration {
+			return stage.rate(elapsed)
+		}
+		elapsed -= stage.duration
+	}
+
+	// A finished profile holds the rate its last stage ended at.
+	return p.stages[len(p.stages)-1].endRate
+}
+
+// Stage returns the index and type of the stage active at the given time since
+// the start of the run. The index is -1 once a non-repeating profile has
+// finished.
+func (p *RateProfile) Stage(elapsed time.Duration) (int, string) {
+	if p.repeat {
+		elapsed %= p.total
+	}
+
+	for index, stage := range p.stages {
+		if elapsed < stage.duration {
+			return index, stage.kind
+		}
+		elapsed -= stage.duration
+	}
+
+	return -1, ""
+}
+
+// Duration returns the length of a single pass through the profile.
+func (p *RateProfile) Duration() time.Duration {
+	return p.total
+}
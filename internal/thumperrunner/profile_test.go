@@ -0,0 +1,116 @@
+package thumperrunner
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateProfile(t *testing.T) {
+	from := 10.0
+
+	testCases := []struct {
+		profile  config.Profile
+		elapsed  time.Duration
+		expected float64
+	}{
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "ramp", From: &from, To: 500, Duration: 5 * time.Minute},
+			}},
+			0,
+			10,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "ramp", From: &from, To: 500, Duration: 5 * time.Minute},
+			}},
+			150 * time.Second,
+			255,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "ramp", To: 200, Duration: time.Minute},
+			}},
+			30 * time.Second,
+			150,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "ramp", From: &from, To: 500, Duration: 5 * time.Minute},
+				{Type: "hold", Duration: 20 * time.Minute},
+			}},
+			10 * time.Minute,
+			500,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "hold", Duration: time.Minute},
+				{Type: "spike", QPS: 2000, Duration: 30 * time.Second},
+			}},
+			75 * time.Second,
+			2000,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "hold", Duration: time.Minute},
+				{Type: "spike", QPS: 2000, Duration: 30 * time.Second},
+				{Type: "hold", Duration: time.Minute},
+			}},
+			2 * time.Minute,
+			100,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "step", QPS: 300, Duration: time.Minute},
+			}},
+			time.Hour,
+			300,
+		},
+		{
+			config.Profile{Stages: []config.ProfileStage{
+				{Type: "sine", QPS: 300, Amplitude: 200, Period: 4 * time.Minute, Duration: 8 * time.Minute},
+			}},
+			time.Minute,
+			500,
+		},
+		{
+			config.Profile{Repeat: true, Stages: []config.ProfileStage{
+				{Type: "step", QPS: 50, Duration: time.Minute},
+				{Type: "step", QPS: 75, Duration: time.Minute},
+			}},
+			4*time.Minute + 30*time.Second,
+			50,
+		},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			profile, err := NewRateProfile(&tc.profile, 100)
+			require.NoError(t, err)
+			require.InDelta(t, tc.expected, profile.Rate(tc.elapsed), .001)
+		})
+	}
+}
+
+func TestRateProfileValidation(t *testing.T) {
+	testCases := []config.Profile{
+		{},
+		{Stages: []config.ProfileStage{{Type: "hold"}}},
+		{Stages: []config.ProfileStage{{Type: "teleport", Duration: time.Minute}}},
+		{Stages: []config.ProfileStage{{Type: "step", QPS: -1, Duration: time.Minute}}},
+		{Stages: []config.ProfileStage{{Type: "sine", QPS: 10, Amplitude: 20, Period: time.Minute, Duration: time.Minute}}},
+		{Stages: []config.ProfileStage{{Type: "sine", QPS: 10, Amplitude: 5, Duration: time.Minute}}},
+	}
+
+	for i, tc := range testCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			_, err := NewRateProfile(&tc, 100)
+			require.Error(t, err)
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package thumperrunner
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// NewSeed returns a seed drawn from the current time, for runs that were not
+// given one.
+func NewSeed() int64 {
+	return time.Now().UnixNano()
+}
+
+// DeriveSeed returns the seed of the named stream with the given index within
+// a run with the given seed, such as the seed of a single worker. Every stream
+// of a run draws a different sequence, which is the same in every run with the
+// same seed.
+func DeriveSeed(seed int64, name string, index int) int64 {
+	for _, c := range name {
+		seed = seed*31 + int64(c)
+	}
+
+	// Seeding a source scrambles its seed, so neighbouring indices still
+	// result in unrelated streams.
+	named := rand.NewSource(seed).Int63()
+	return rand.NewSource(named + int64(index)).Int63()
+}
+
+// NewRand returns a random number generator drawing from the given seed,
+// which is safe for concurrent use.
+func NewRand(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// lockedSource guards a source that may be drawn from concurrently, since the
+// sources of math/rand are not safe for concurrent use.
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
@@ -0,0 +1,152 @@
+package thumperrunner
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveSeed(t *testing.T) {
+	require.Equal(t, DeriveSeed(42, "worker", 3), DeriveSeed(42, "worker", 3))
+
+	seen := make(map[int64]string)
+	for _, seed := range []int64{0, 1, 42} {
+		for _, name := range []string{"worker", "scripts", "scheduler"} {
+			for index := 0; index < 100; index++ {
+				derived := DeriveSeed(seed, name, index)
+				_, duplicate := seen[derived]
+				require.False(t, duplicate, "seed %d of %s %d is a duplicate", seed, name, index)
+				seen[derived] = name
+			}
+		}
+	}
+}
+
+func TestNewRandConcurrent(t *testing.T) {
+	rng := NewRand(1)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				rng.Intn(100)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSeededWorkerPicks(t *testing.T) {
+	scripts := []*ExecutableScript{
+		{name: "a", weight: 1, steps: make([]executableStep, 5)},
+		{name: "b", weight: 2, steps: make([]executableStep, 5)},
+		{name: "c", weight: 3, steps: make([]executableStep, 5)},
+	}
+
+	picks := func(seed int64) []int {
+		worker, err := NewWorker(WorkerOptions{
+			Clients:           NewClientPool(&authzed.Client{}),
+			Scripts:           scripts,
+			StepRandomization: true,
+			Rand:              NewRand(seed),
+		})
+		require.NoError(t, err)
+
+		var picked []int
+		for _, executable := range worker.contexts {
+			picked = append(picked, executable.numExecuted)
+		}
+		for i := 0; i < 50; i++ {
+			index, ok := worker.pick()
+			require.True(t, ok)
+			picked = append(picked, index)
+		}
+		return picked
+	}
+
+	require.Equal(t, picks(7), picks(7))
+	require.NotEqual(t, picks(7), picks(8))
+}
+
+func TestSeededWorkerIterations(t *testing.T) {
+	sleep, err := prepareSleep(config.ScriptStep{Op: "Sleep", Duration: 2 * time.Millisecond, Distribution: "uniform"})
+	require.NoError(t, err)
+
+	// Each step records the values it expanded under the iteration that
+	// expanded them, since the iterations finish in no particular order.
+	var mu sync.Mutex
+	var expanded map[*bindings][]string
+	expand := func(s string) func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error) {
+		return func(_ context.Context, _ *authzed.Client, _ *v1.ZedToken, b *bindings) (*v1.ZedToken, error) {
+			value, err := b.expand(s)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			expanded[b] = append(expanded[b], value)
+			return nil, nil
+		}
+	}
+	steps := []executableStep{
+		{op: "CheckPermission", body: expand("document:${rand:doc}")},
+		{op: "Sleep", sleep: sleep},
+		{op: "CheckPermission", body: expand("user:${rand:user}")},
+		{op: "Sleep", sleep: sleep},
+		{op: "CheckPermission", body: expand("document:${rand:doc}")},
+	}
+	scripts := []*ExecutableScript{
+		{name: "steps", weight: 1, steps: steps},
+		{name: "session", weight: 1, session: true, steps: steps},
+	}
+
+	iterations := func(seed int64) []string {
+		expanded = make(map[*bindings][]string)
+		worker, err := NewWorker(WorkerOptions{
+			Clients:           NewClientPool(&authzed.Client{}),
+			Scripts:           scripts,
+			StepTimeout:       time.Second,
+			StepRandomization: true,
+			Results:           NewResults(),
+			Rand:              NewRand(seed),
+		})
+		require.NoError(t, err)
+
+		// Dispatch the iterations like the scheduler does, so that they
+		// overlap.
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			index, ok := worker.pick()
+			require.True(t, ok)
+			it := worker.dispatch(index)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				worker.run(context.Background(), it, time.Now())
+			}()
+		}
+		wg.Wait()
+
+		described := make([]string, 0, len(expanded))
+		for _, values := range expanded {
+			slices.Sort(values)
+			described = append(described, strings.Join(values, " "))
+		}
+		slices.Sort(described)
+		return described
+	}
+
+	require.Equal(t, iterations(7), iterations(7))
+	require.NotEqual(t, iterations(7), iterations(8))
+}
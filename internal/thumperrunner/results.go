@@ -0,0 +1,205 @@
+package thumperrunner
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// TotalOp is the name of the summary row that aggregates all operations.
+const TotalOp = "total"
+
+// Results collects the outcome of every executed step, grouped by operation.
+// It is safe for concurrent use.
+type Results struct {
+	mu  sync.Mutex
+	ops map[string]*opResults
+}
+
+type opResults struct {
+	errors   uint64
+	service  histogram
+	response histogram
+}
+
+// NewResults creates an empty set of results.
+func NewResults() *Results {
+	return &Results{ops: make(map[string]*opResults)}
+}
+
+func (r *Results) record(op string, service, response time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	res, ok := r.ops[op]
+	if !ok {
+		res = &opResults{}
+		r.ops[op] = res
+	}
+
+	res.service.record(service)
+	res.response.record(response)
+	if err != nil {
+		res.errors++
+	}
+}
+
+// Reset discards everything recorded so far.
+func (r *Results) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.ops = make(map[string]*opResults)
+}
+
+// ResultsSnapshot is a serializable copy of Results, which allows results
+// collected by several processes to be combined.
+type ResultsSnapshot struct {
+	Ops map[string]OpSnapshot
+}
+
+// OpSnapshot is a serializable copy of the results of a single operation.
+type OpSnapshot struct {
+	Errors   uint64
+	Service  HistogramSnapshot
+	Response HistogramSnapshot
+}
+
+// HistogramSnapshot is a serializable copy of a latency histogram.
+type HistogramSnapshot struct {
+	Counts  []uint64
+	Total   uint64
+	Sum     time.Duration
+	Lowest  time.Duration
+	Highest time.Duration
+}
+
+func (h *histogram) snapshot() HistogramSnapshot {
+	return HistogramSnapshot{
+		Counts:  append([]uint64(nil), h.counts...),
+		Total:   h.total,
+		Sum:     h.sum,
+		Lowest:  h.lowest,
+		Highest: h.highest,
+	}
+}
+
+func (s HistogramSnapshot) histogram() *histogram {
+	return &histogram{
+		counts:  s.Counts,
+		total:   s.Total,
+		sum:     s.Sum,
+		lowest:  s.Lowest,
+		highest: s.Highest,
+	}
+}
+
+// Snapshot returns a copy of everything recorded so far.
+func (r *Results) Snapshot() ResultsSnapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	snapshot := ResultsSnapshot{Ops: make(map[string]OpSnapshot, len(r.ops))}
+	for op, res := range r.ops {
+		snapshot.Ops[op] = OpSnapshot{
+			Errors:   res.errors,
+			Service:  res.service.snapshot(),
+			Response: res.response.snapshot(),
+		}
+	}
+	return snapshot
+}
+
+// Merge adds the results in the snapshot to the ones recorded so far.
+func (r *Results) Merge(snapshot ResultsSnapshot) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for op, opSnapshot := range snapshot.Ops {
+		res, ok := r.ops[op]
+		if !ok {
+			res = &opResults{}
+			r.ops[op] = res
+		}
+
+		res.errors += opSnapshot.Errors
+		res.service.merge(opSnapshot.Service.histogram())
+		res.response.merge(opSnapshot.Response.histogram())
+	}
+}
+
+// LatencySummary describes the distribution of one view of the latency of an
+// operation.
+type LatencySummary struct {
+	Mean time.Duration
+	P50  time.Duration
+	P90  time.Duration
+	P99  time.Duration
+	Max  time.Duration
+}
+
+func summarizeLatency(h *histogram) LatencySummary {
+	return LatencySummary{
+		Mean: h.mean(),
+		P50:  h.quantile(.50),
+		P90:  h.quantile(.90),
+		P99:  h.quantile(.99),
+		Max:  h.highest,
+	}
+}
+
+// OpSummary is the aggregated outcome of a single operation.
+type OpSummary struct {
+	Op     string
+	Count  uint64
+	Errors uint64
+
+	// Service is the latency from sending a request until it completed.
+	Service LatencySummary
+
+	// Response is the latency from when a request was scheduled to be sent
+	// until it completed. Unlike Service, it includes the time requests
+	// spent waiting behind a stalled client or server, and so does not
+	// suffer from coordinated omission.
+	Response LatencySummary
+}
+
+// ErrorRate returns the fraction of calls that failed.
+func (s OpSummary) ErrorRate() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Count)
+}
+
+func summarize(op string, res *opResults) OpSummary {
+	return OpSummary{
+		Op:       op,
+		Count:    res.service.total,
+		Errors:   res.errors,
+		Service:  summarizeLatency(&res.service),
+		Response: summarizeLatency(&res.response),
+	}
+}
+
+// Summary returns a summary per operation sorted by name, followed by one for
+// all operations combined.
+func (r *Results) Summary() []OpSummary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	summaries := make([]OpSummary, 0, len(r.ops)+1)
+	var total opResults
+	for op, res := range r.ops {
+		summaries = append(summaries, summarize(op, res))
+		total.service.merge(&res.service)
+		total.response.merge(&res.response)
+		total.errors += res.errors
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		return summaries[i].Op < summaries[j].Op
+	})
+
+	return append(summaries, summarize(TotalOp, &total))
+}
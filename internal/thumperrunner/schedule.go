@@ -0,0 +1,403 @@
+package thumperrunner
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+// maxWait bounds how long the scheduler sleeps before re-evaluating the target
+// rate, so that rate changes are picked up even while traffic is slow.
+const maxWait = 100 * time.Millisecond
+
+var targetQPSGauge = promauto.NewGauge(prometheus.GaugeOpts{
+	Namespace: "thumper",
+	Name:      "target_qps",
+	Help:      "The rate of requests the scheduler is currently aiming for.",
+})
+
+// SchedulerOptions represent the configuration for the open-loop scheduler.
+type SchedulerOptions struct {
+	Workers []*Worker
+	QPS     float64
+	Arrival ArrivalMode
+
+	// Profile optionally varies the rate over the course of the run, in
+	// which case QPS is ignored.
+	Profile *RateProfile
+
+	// Limits optionally bound the length of the run.
+	Limits RunLimits
+
+	// Share, when set, is the fraction of a distributed run that this
+	// scheduler is responsible for, which scales the rates of scripts with a
+	// rate of their own. Zero means the whole run.
+	Share float64
+
+	// Rand, when set, draws the arrivals, so that schedulers created with the
+	// same seed space requests the same way. Otherwise the scheduler gets a
+	// generator seeded from the current time.
+	Rand *rand.Rand
+}
+
+// Scheduler generates requests at a target rate, independent of how long
+// previous requests take to complete, and hands each of them to the next
+// worker in round-robin order. Scripts with a rate of their own get requests
+// at that rate, and the rest of the target rate is spread over the other
+// scripts by weight.
+type Scheduler struct {
+	workers []*Worker
+	qps     float64
+	arrival ArrivalMode
+	profile *RateProfile
+	limits  RunLimits
+	lanes   []*lane
+	rng     *rand.Rand
+
+	inflight sync.WaitGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// mu guards the changes made to a running scheduler, which take effect
+	// within maxWait.
+	mu       sync.Mutex
+	override *float64
+	paused   bool
+
+	started    atomic.Pointer[time.Time]
+	dispatched atomic.Int64
+}
+
+// lane is a stream of arrivals with a rate of its own, which either runs a
+// single script or picks scripts by weight.
+type lane struct {
+	// script is the index of the script the lane runs, or -1 for the lane
+	// that picks scripts by weight.
+	script int
+	qps    float64
+
+	// remaining is the number of units left to consume before the next
+	// arrival, which the arrival mode draws with a mean of one.
+	remaining float64
+}
+
+// untilArrival returns how long the lane takes to consume its remaining
+// units at the given rate.
+func (l *lane) untilArrival(rate float64) time.Duration {
+	return time.Duration(l.remaining / rate * float64(time.Second))
+}
+
+// NewScheduler creates a scheduler from the given options.
+func NewScheduler(options SchedulerOptions) *Scheduler {
+	share := options.Share
+	if share == 0 {
+		share = 1
+	}
+
+	rng := options.Rand
+	if rng == nil {
+		rng = NewRand(NewSeed())
+	}
+
+	lanes := []*lane{{script: -1}}
+	if len(options.Workers) > 0 {
+		for index, executable := range options.Workers[0].contexts {
+			if executable.script.qps > 0 {
+				lanes = append(lanes, &lane{script: index, qps: executable.script.qps * share})
+			}
+		}
+	}
+
+	return &Scheduler{
+		workers: options.Workers,
+		qps:     options.QPS,
+		arrival: options.Arrival,
+		profile: options.Profile,
+		limits:  options.Limits,
+		lanes:   lanes,
+		rng:     rng,
+		stop:    make(chan struct{}),
+	}
+}
+
+// laneRates fills in the rate of every lane at the given point of the run,
+// and returns their total. The lane that picks scripts by weight gets
+// whatever the target rate leaves after the other lanes.
+func (s *Scheduler) laneRates(elapsed time.Duration, rates []float64) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		clear(rates)
+		return 0
+	}
+
+	var total float64
+	for index, l := range s.lanes {
+		if l.script >= 0 {
+			rates[index] = l.qps
+			total += l.qps
+		}
+	}
+	rates[0] = max(0, s.targetRateLocked(elapsed)-total)
+	return total + rates[0]
+}
+
+// Stop makes Run stop issuing requests, as if a run limit had been reached.
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// SetQPS changes the target rate of a running scheduler, which replaces any
+// load profile for the rest of the run.
+func (s *Scheduler) SetQPS(qps float64) error {
+	if qps <= 0 || math.IsInf(qps, 0) || math.IsNaN(qps) {
+		return fmt.Errorf("qps must be positive, got %v", qps)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.override == nil && s.profile != nil {
+		log.Info().Float64("qps", qps).Msg("replacing load profile with a fixed rate")
+	} else {
+		log.Info().Float64("qps", qps).Msg("changing target rate")
+	}
+	s.override = &qps
+	return nil
+}
+
+// Pause stops issuing requests until Resume is called. Steps that are in
+// flight are allowed to finish, and run limits keep counting down.
+func (s *Scheduler) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.paused {
+		log.Info().Msg("pausing scheduler")
+	}
+	s.paused = true
+}
+
+// Resume continues issuing requests after Pause, without making up for the
+// requests that were skipped while paused.
+func (s *Scheduler) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		log.Info().Msg("resuming scheduler")
+	}
+	s.paused = false
+}
+
+// SchedulerStatus describes a scheduler at a point in time.
+type SchedulerStatus struct {
+	// TargetQPS is the rate the scheduler issues requests at when it is not
+	// paused.
+	TargetQPS  float64
+	Paused     bool
+	Dispatched int64
+	Elapsed    time.Duration
+}
+
+// Status returns the current status of the scheduler.
+func (s *Scheduler) Status() SchedulerStatus {
+	var elapsed time.Duration
+	if started := s.started.Load(); started != nil {
+		elapsed = time.Since(*started)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SchedulerStatus{
+		TargetQPS:  s.targetRateLocked(elapsed),
+		Paused:     s.paused,
+		Dispatched: s.dispatched.Load(),
+		Elapsed:    elapsed,
+	}
+}
+
+func (s *Scheduler) rate(elapsed time.Duration) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.paused {
+		return 0
+	}
+	return s.targetRateLocked(elapsed)
+}
+
+func (s *Scheduler) targetRateLocked(elapsed time.Duration) float64 {
+	switch {
+	case s.override != nil:
+		return *s.override
+	case s.profile != nil:
+		return s.profile.Rate(elapsed)
+	default:
+		return s.qps
+	}
+}
+
+func (s *Scheduler) profileReplaced() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.override != nil
+}
+
+// Run issues requests until the context is cancelled or one of the run limits
+// is reached, and then drains in-flight steps, returning why it stopped. Steps
+// are not cancelled along with the context, but only once the drain timeout
+// has passed.
+func (s *Scheduler) Run(ctx context.Context) string {
+	log.Info().
+		Float64("qps", s.rate(0)).
+		Str("arrival", string(s.arrival)).
+		Int("workers", len(s.workers)).
+		Bool("profile", s.profile != nil).
+		Msg("starting scheduler")
+
+	for _, l := range s.lanes[1:] {
+		log.Info().
+			Str("script", s.workers[0].contexts[l.script].script.name).
+			Float64("qps", l.qps).
+			Msg("script runs at a rate of its own")
+	}
+
+	stepCtx, cancelSteps := context.WithCancel(context.WithoutCancel(ctx))
+
+	// Arrivals are scheduled against absolute times so that timer jitter and
+	// slow dispatching do not accumulate into a lower effective rate.
+	start := time.Now()
+	s.started.Store(&start)
+	next := start
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	var deadline <-chan time.Time
+	if s.limits.Duration > 0 {
+		deadlineTimer := time.NewTimer(s.limits.Duration)
+		defer deadlineTimer.Stop()
+		deadline = deadlineTimer.C
+	}
+
+	var dispatched int
+	var reason string
+	stage := -1
+	rates := make([]float64, len(s.lanes))
+	for _, l := range s.lanes {
+		l.remaining = s.arrival.draw(s.rng)
+	}
+schedule:
+	for {
+		select {
+		case <-ctx.Done():
+			reason = "cancelled"
+			break schedule
+		case <-deadline:
+			reason = "duration reached"
+			break schedule
+		case <-s.stop:
+			reason = "stopped"
+			break schedule
+		case <-timer.C:
+		}
+
+		for _, l := range s.lanes {
+			if l.remaining > 0 {
+				continue
+			}
+			l.remaining = s.arrival.draw(s.rng)
+
+			if s.limits.Iterations != nil && s.limits.Iterations.Exhausted() {
+				reason = "iterations reached"
+				break schedule
+			}
+
+			// Scripts are picked here rather than by the step itself, so that
+			// a worker picks them in the order the requests were scheduled.
+			worker, index := s.workers[dispatched%len(s.workers)], l.script
+			if index >= 0 {
+				if !worker.take(index) {
+					continue
+				}
+			} else {
+				var ok bool
+				if index, ok = worker.pick(); !ok {
+					continue
+				}
+			}
+
+			// The timer fired for the arrival scheduled at next, however late
+			// it actually fired.
+			scheduled := next
+			it := worker.dispatch(index)
+			dispatched++
+			s.dispatched.Store(int64(dispatched))
+			s.inflight.Add(1)
+			go func() {
+				defer s.inflight.Done()
+				worker.run(stepCtx, it, scheduled)
+			}()
+
+			if s.limits.Requests > 0 && dispatched >= s.limits.Requests {
+				reason = "requests reached"
+				break schedule
+			}
+		}
+
+		elapsed := next.Sub(start)
+		rate := s.laneRates(elapsed, rates)
+		targetQPSGauge.Set(rate)
+
+		if s.profile != nil && !s.profileReplaced() {
+			if index, kind := s.profile.Stage(elapsed); index != stage {
+				stage = index
+				if index < 0 {
+					log.Info().Float64("qps", rate).Msg("load profile finished, holding final rate")
+				} else {
+					log.Info().Int("stage", index).Str("type", kind).Float64("qps", rate).Msg("entering load profile stage")
+				}
+			}
+		}
+
+		// Consume the remaining units of every lane at its current rate until
+		// the earliest arrival, but never sleep longer than maxWait without
+		// looking at the rates again.
+		wait := maxWait
+		for index, l := range s.lanes {
+			if rates[index] > 0 {
+				wait = min(wait, l.untilArrival(rates[index]))
+			}
+		}
+		for index, l := range s.lanes {
+			if rates[index] > 0 && l.untilArrival(rates[index]) <= wait {
+				l.remaining = 0
+			} else {
+				l.remaining -= rates[index] * wait.Seconds()
+			}
+		}
+
+		next = next.Add(wait)
+		timer.Reset(time.Until(next))
+	}
+
+	log.Info().Str("reason", reason).Int("dispatched", dispatched).Msg("stopping scheduler, draining in-flight steps")
+
+	drained := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(drained)
+	}()
+	s.limits.drain(drained, cancelSteps)
+	return reason
+}
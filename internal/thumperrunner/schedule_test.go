@@ -0,0 +1,213 @@
+package thumperrunner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchedulerDrain(t *testing.T) {
+	tests := []struct {
+		name           string
+		stepDuration   time.Duration
+		drainTimeout   time.Duration
+		expectedErrors bool
+	}{
+		{"in-flight steps finish", 50 * time.Millisecond, time.Second, false},
+		{"unlimited drain", 50 * time.Millisecond, 0, false},
+		{"in-flight steps are cancelled", time.Minute, 20 * time.Millisecond, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			script := &ExecutableScript{name: "slow", weight: 1, steps: []executableStep{{
+				op: "CheckPermission",
+				body: func(ctx context.Context, _ *authzed.Client, _ *v1.ZedToken, _ *bindings) (*v1.ZedToken, error) {
+					select {
+					case <-ctx.Done():
+						return nil, ctx.Err()
+					case <-time.After(tt.stepDuration):
+						return nil, nil
+					}
+				},
+			}}}
+
+			results := NewResults()
+			worker, err := NewWorker(WorkerOptions{
+				Clients:     NewClientPool(&authzed.Client{}),
+				Scripts:     []*ExecutableScript{script},
+				StepTimeout: 2 * time.Minute,
+				Results:     results,
+			})
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			NewScheduler(SchedulerOptions{
+				Workers: []*Worker{worker},
+				QPS:     100,
+				Arrival: ArrivalFixed,
+				Limits:  RunLimits{DrainTimeout: tt.drainTimeout},
+			}).Run(ctx)
+			require.Less(t, time.Since(start), 5*time.Second)
+
+			summaries := results.Summary()
+			total := summaries[len(summaries)-1]
+			require.Positive(t, total.Count)
+			if tt.expectedErrors {
+				require.Equal(t, total.Count, total.Errors)
+			} else {
+				require.Zero(t, total.Errors)
+			}
+		})
+	}
+}
+
+func TestSchedulerPinnedScripts(t *testing.T) {
+	tests := []struct {
+		name             string
+		qps              float64
+		share            float64
+		expectedPinned   float64
+		expectedWeighted float64
+	}{
+		{"remainder spread by weight", 1000, 0, 500, 500},
+		{"pinned rate exceeds target", 300, 0, 500, 0},
+		{"share of a distributed run", 1000, .5, 250, 750},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instant := func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error) {
+				return nil, nil
+			}
+			scripts := []*ExecutableScript{
+				{name: "writes", qps: 500, steps: []executableStep{{op: "WriteRelationships", body: instant}}},
+				{name: "reads", weight: 1, steps: []executableStep{{op: "CheckPermission", body: instant}}},
+			}
+
+			results := NewResults()
+			worker, err := NewWorker(WorkerOptions{
+				Clients:     NewClientPool(&authzed.Client{}),
+				Scripts:     scripts,
+				StepTimeout: time.Second,
+				Results:     results,
+			})
+			require.NoError(t, err)
+
+			// Arrivals are dispatched in the order they were scheduled, even
+			// when the scheduler falls behind, so the split of a run bounded
+			// by requests does not depend on how fast it ran.
+			const requests = 200
+			NewScheduler(SchedulerOptions{
+				Workers: []*Worker{worker},
+				QPS:     tt.qps,
+				Arrival: ArrivalFixed,
+				Limits:  RunLimits{Requests: requests},
+				Share:   tt.share,
+			}).Run(context.Background())
+
+			counts := make(map[string]float64)
+			for _, summary := range results.Summary() {
+				counts[summary.Op] = float64(summary.Count)
+			}
+			total := tt.expectedPinned + tt.expectedWeighted
+			require.InDelta(t, requests*tt.expectedPinned/total, counts["WriteRelationships"], 1)
+			require.InDelta(t, requests*tt.expectedWeighted/total, counts["CheckPermission"], 1)
+		})
+	}
+}
+
+func TestSchedulerLimits(t *testing.T) {
+	tests := []struct {
+		name           string
+		limits         func(scripts []*ExecutableScript) RunLimits
+		stop           bool
+		expectedReason string
+		expectedCount  uint64
+	}{
+		{
+			name:           "requests",
+			limits:         func([]*ExecutableScript) RunLimits { return RunLimits{Requests: 7} },
+			expectedReason: "requests reached",
+			expectedCount:  7,
+		},
+		{
+			name: "iterations",
+			limits: func(scripts []*ExecutableScript) RunLimits {
+				return RunLimits{Iterations: NewIterationBudget(scripts, 3)}
+			},
+			expectedReason: "iterations reached",
+			expectedCount:  6,
+		},
+		{
+			name:           "duration",
+			limits:         func([]*ExecutableScript) RunLimits { return RunLimits{Duration: 100 * time.Millisecond} },
+			expectedReason: "duration reached",
+		},
+		{
+			name:           "stopped",
+			limits:         func([]*ExecutableScript) RunLimits { return RunLimits{} },
+			stop:           true,
+			expectedReason: "stopped",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			instant := func(context.Context, *authzed.Client, *v1.ZedToken, *bindings) (*v1.ZedToken, error) {
+				return nil, nil
+			}
+			scripts := []*ExecutableScript{{name: "reads", weight: 1, steps: []executableStep{
+				{op: "CheckPermission", body: instant},
+				{op: "LookupResources", body: instant},
+			}}}
+			limits := tt.limits(scripts)
+
+			results := NewResults()
+			worker, err := NewWorker(WorkerOptions{
+				Clients:     NewClientPool(&authzed.Client{}),
+				Scripts:     scripts,
+				StepTimeout: time.Second,
+				Results:     results,
+				Budget:      limits.Iterations,
+			})
+			require.NoError(t, err)
+
+			scheduler := NewScheduler(SchedulerOptions{
+				Workers: []*Worker{worker},
+				QPS:     200,
+				Arrival: ArrivalFixed,
+				Limits:  limits,
+			})
+			if tt.stop {
+				time.AfterFunc(100*time.Millisecond, scheduler.Stop)
+			}
+
+			// The context only ends runs whose limits fail to.
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			start := time.Now()
+			require.Equal(t, tt.expectedReason, scheduler.Run(ctx))
+			elapsed := time.Since(start)
+
+			summaries := results.Summary()
+			total := summaries[len(summaries)-1]
+			if tt.expectedCount > 0 {
+				require.Equal(t, tt.expectedCount, total.Count)
+			} else {
+				// However slow the machine, no more arrivals than the rate
+				// allows in the time the run took are dispatched.
+				require.Positive(t, total.Count)
+				require.LessOrEqual(t, float64(total.Count), 200*elapsed.Seconds()+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+package thumperrunner
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// fakePermissions is a permissions service that serves canned responses.
+// Calls it has no response for fail as unimplemented.
+type fakePermissions struct {
+	v1.UnimplementedPermissionsServiceServer
+
+	resources     []string
+	subjects      []*v1.LookupSubjectsResponse
+	relationships []*v1.Relationship
+	tree          *v1.PermissionRelationshipTree
+	checked       chan *v1.CheckPermissionRequest
+	imported      chan []*v1.Relationship
+
+	// writeErr, when set, fails every write.
+	writeErr error
+
+	// streamed counts the calls to the streaming lookups and reads.
+	streamed atomic.Int64
+}
+
+// page returns the range of the results of a paginated call to serve, from
+// its cursor to its limit, and the cursor after each of them.
+func page(limit uint32, cursor *v1.Cursor, results int) (start, end int, after func(int) *v1.Cursor) {
+	if cursor != nil {
+		start, _ = strconv.Atoi(cursor.Token)
+	}
+	end = results
+	if limit > 0 {
+		end = min(end, start+int(limit))
+	}
+	return start, end, func(i int) *v1.Cursor {
+		return &v1.Cursor{Token: strconv.Itoa(i + 1)}
+	}
+}
+
+func (f *fakePermissions) ImportBulkRelationships(stream grpc.ClientStreamingServer[v1.ImportBulkRelationshipsRequest, v1.ImportBulkRelationshipsResponse]) error {
+	var loaded uint64
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return stream.SendAndClose(&v1.ImportBulkRelationshipsResponse{NumLoaded: loaded})
+		}
+		if err != nil {
+			return err
+		}
+		f.imported <- req.Relationships
+		loaded += uint64(len(req.Relationships))
+	}
+}
+
+func (f *fakePermissions) ExportBulkRelationships(req *v1.ExportBulkRelationshipsRequest, stream grpc.ServerStreamingServer[v1.ExportBulkRelationshipsResponse]) error {
+	remaining := f.relationships
+	for len(remaining) > 0 {
+		page := remaining
+		if limit := int(req.OptionalLimit); limit > 0 && limit < len(page) {
+			page = page[:limit]
+		}
+		if err := stream.Send(&v1.ExportBulkRelationshipsResponse{Relationships: page}); err != nil {
+			return err
+		}
+		remaining = remaining[len(page):]
+	}
+	return nil
+}
+
+func (f *fakePermissions) ReadRelationships(req *v1.ReadRelationshipsRequest, stream grpc.ServerStreamingServer[v1.ReadRelationshipsResponse]) error {
+	f.streamed.Add(1)
+	start, end, after := page(req.OptionalLimit, req.OptionalCursor, len(f.relationships))
+	for i := start; i < end; i++ {
+		if err := stream.Send(&v1.ReadRelationshipsResponse{Relationship: f.relationships[i], AfterResultCursor: after(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakePermissions) LookupResources(req *v1.LookupResourcesRequest, stream grpc.ServerStreamingServer[v1.LookupResourcesResponse]) error {
+	f.streamed.Add(1)
+	start, end, after := page(req.OptionalLimit, req.OptionalCursor, len(f.resources))
+	for i := start; i < end; i++ {
+		if err := stream.Send(&v1.LookupResourcesResponse{ResourceObjectId: f.resources[i], AfterResultCursor: after(i)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakePermissions) LookupSubjects(_ *v1.LookupSubjectsRequest, stream grpc.ServerStreamingServer[v1.LookupSubjectsResponse]) error {
+	for _, subject := range f.subjects {
+		if err := stream.Send(subject); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakePermissions) ExpandPermissionTree(ctx context.Context, req *v1.ExpandPermissionTreeRequest) (*v1.ExpandPermissionTreeResponse, error) {
+	if f.tree == nil {
+		return f.UnimplementedPermissionsServiceServer.ExpandPermissionTree(ctx, req)
+	}
+	return &v1.ExpandPermissionTreeResponse{TreeRoot: f.tree}, nil
+}
+
+func (f *fakePermissions) WriteRelationships(context.Context, *v1.WriteRelationshipsRequest) (*v1.WriteRelationshipsResponse, error) {
+	if f.writeErr != nil {
+		return nil, f.writeErr
+	}
+	return &v1.WriteRelationshipsResponse{WrittenAt: &v1.ZedToken{Token: "written"}}, nil
+}
+
+func (f *fakePermissions) CheckPermission(_ context.Context, req *v1.CheckPermissionRequest) (*v1.CheckPermissionResponse, error) {
+	f.checked <- req
+	return &v1.CheckPermissionResponse{
+		Permissionship: v1.CheckPermissionResponse_PERMISSIONSHIP_HAS_PERMISSION,
+	}, nil
+}
+
+// fakeWatch is a watch service that serves one stream after another, each of
+// which sends its responses and then ends with its error, or stays open if it
+// has none. The requests that opened the streams are sent to requests.
+type fakeWatch struct {
+	v1.UnimplementedWatchServiceServer
+
+	streams  []fakeWatchStream
+	requests chan *v1.WatchRequest
+	opened   atomic.Int64
+}
+
+type fakeWatchStream struct {
+	responses []*v1.WatchResponse
+	err       error
+}
+
+func (f *fakeWatch) Watch(req *v1.WatchRequest, stream grpc.ServerStreamingServer[v1.WatchResponse]) error {
+	index := int(f.opened.Add(1) - 1)
+	f.requests <- req
+	if index >= len(f.streams) {
+		<-stream.Context().Done()
+		return nil
+	}
+
+	for _, resp := range f.streams[index].responses {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	if f.streams[index].err == nil {
+		<-stream.Context().Done()
+	}
+	return f.streams[index].err
+}
+
+// startFakeServer serves the fake permissions service, and returns a client
+// connected to it.
+func startFakeServer(t *testing.T, permissions v1.PermissionsServiceServer) *authzed.Client {
+	t.Helper()
+	return serveFake(t, func(server *grpc.Server) {
+		v1.RegisterPermissionsServiceServer(server, permissions)
+	})
+}
+
+// startFakeWatchServer serves the fake watch service, and returns a client
+// connected to it.
+func startFakeWatchServer(t *testing.T, watch v1.WatchServiceServer) *authzed.Client {
+	t.Helper()
+	return serveFake(t, func(server *grpc.Server) {
+		v1.RegisterWatchServiceServer(server, watch)
+	})
+}
+
+func serveFake(t *testing.T, register func(*grpc.Server)) *authzed.Client {
+	t.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	register(server)
+	go func() {
+		_ = server.Serve(lis)
+	}()
+	t.Cleanup(server.Stop)
+
+	client, err := authzed.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+
+	return client
+}
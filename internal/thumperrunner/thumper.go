@@ -1,13 +1,13 @@
 package thumperrunner
 
 import (
+	"context"
+	"fmt"
 	"math/rand"
-	"os"
-	"os/signal"
-	"syscall"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/authzed/authzed-go/v1"
 	"github.com/mroth/weightedrand"
 	"github.com/rs/zerolog/log"
 )
@@ -15,47 +15,301 @@ import (
 // WorkerOptions represent the configuration for the worker
 type WorkerOptions struct {
 	Index             int
-	Client            *authzed.Client
+	Clients           *ClientPool
 	Scripts           []*ExecutableScript
 	StepTimeout       time.Duration
 	StepRandomization bool
+
+	// Results, when set, receives the outcome of every step.
+	Results *Results
+
+	// Budget, when set, limits the number of passes made over each script.
+	Budget *IterationBudget
+
+	// Breaker, when set, is told the outcome of every step.
+	Breaker *CircuitBreaker
+
+	// Watcher, when set, is told about every relationship the worker writes,
+	// to measure how long it takes to arrive over the Watch API.
+	Watcher *Watcher
+
+	// Rand, when set, drives every random choice the worker makes, so that
+	// workers created with the same seed make the same choices. Otherwise the
+	// worker gets a generator seeded from the current time.
+	Rand *rand.Rand
+}
+
+// Worker owns the execution state of one copy of the executable scripts and
+// advances a randomly chosen script every time it is asked to step. A worker
+// may be stepped concurrently, in which case its steps overlap.
+type Worker struct {
+	index       int
+	stepTimeout time.Duration
+	contexts    []*ExecutableContext
+	budget      *IterationBudget
+
+	// rng picks the scripts, and is only drawn from by the goroutine that
+	// dispatches the iterations of the worker. Every iteration draws its
+	// own random choices from a generator derived from seed and its number
+	// in the order of dispatch, so that they do not depend on how the
+	// iterations overlap.
+	rng        *rand.Rand
+	seed       int64
+	iterations atomic.Int64
+
+	// mu guards the weights, which start out as the weights of the scripts
+	// and can be changed while the worker runs.
+	mu      sync.Mutex
+	weights []uint
+
+	// chooser is replaced when scripts run out of budget or their weights
+	// change, and is nil once there is nothing left to run.
+	chooser atomic.Pointer[weightedrand.Chooser]
 }
 
-// RunWorker runs a worker, with the given index and set of executable Scripts.
-func RunWorker(options WorkerOptions) {
-	choices := make([]weightedrand.Choice, 0)
+// NewWorker creates a worker, with the given index and set of executable Scripts.
+func NewWorker(options WorkerOptions) (*Worker, error) {
+	rng := options.Rand
+	if rng == nil {
+		rng = NewRand(NewSeed())
+	}
+
+	worker := &Worker{
+		index:       options.Index,
+		stepTimeout: options.StepTimeout,
+		contexts:    make([]*ExecutableContext, 0, len(options.Scripts)),
+		budget:      options.Budget,
+		rng:         rng,
+		weights:     make([]uint, 0, len(options.Scripts)),
+	}
+
 	for _, script := range options.Scripts {
+		// Every step of a script that is not a session runs on its own,
+		// so there is no previous step for an if to follow.
+		if script.followsPrevious && !script.session {
+			return nil, fmt.Errorf("script %s has an if on the previous step, which requires mode: session", script.name)
+		}
+
 		numExecuted := 0
 		if options.StepRandomization {
-			numExecuted = rand.Intn(len(script.steps))
+			numExecuted = rng.Intn(len(script.steps))
 		}
-		executable := &ExecutableContext{
+		worker.contexts = append(worker.contexts, &ExecutableContext{
 			script:      script,
-			client:      options.Client,
+			clients:     options.Clients,
+			results:     options.Results,
+			breaker:     options.Breaker,
+			watcher:     options.Watcher,
 			numExecuted: numExecuted,
+		})
+		worker.weights = append(worker.weights, script.weight)
+	}
+	worker.seed = rng.Int63()
+
+	if err := worker.updateChooser(); err != nil {
+		return nil, err
+	}
+
+	log.Info().Int("worker", options.Index).Msg("created worker")
+
+	return worker, nil
+}
+
+// updateChooser pre-processes the scripts that still have budget left into a
+// chooser.
+func (w *Worker) updateChooser() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.updateChooserLocked()
+}
+
+func (w *Worker) updateChooserLocked() error {
+	chooser, err := w.chooserLocked(w.weights)
+	if err != nil {
+		return err
+	}
+	w.chooser.Store(chooser)
+	return nil
+}
+
+// chooserLocked returns a chooser of the scripts with the given weights that
+// have budget left, or nil if there are none.
+func (w *Worker) chooserLocked(weights []uint) (*weightedrand.Chooser, error) {
+	choices := make([]weightedrand.Choice, 0, len(w.contexts))
+	var available, pinned bool
+	for index, weight := range weights {
+		// Scripts with a rate of their own are stepped by StepScript.
+		if w.contexts[index].script.qps > 0 {
+			pinned = true
+			continue
 		}
-		choices = append(choices, weightedrand.NewChoice(executable, script.weight))
+		if w.budget != nil && !w.budget.available(index) {
+			continue
+		}
+		choices = append(choices, weightedrand.NewChoice(index, weight))
+		available = true
+	}
+
+	if (w.budget != nil || pinned) && !available {
+		return nil, nil
 	}
 
-	// Pre-process the configuration options into a chooser
 	chooser, err := weightedrand.NewChooser(choices...)
 	if err != nil {
-		log.Fatal().Err(err).Msg("unable to create weighted random chooser")
+		return nil, fmt.Errorf("unable to create weighted random chooser: %w", err)
+	}
+	return chooser, nil
+}
+
+// Weights returns the current weight of every script, by script name.
+func (w *Worker) Weights() map[string]uint {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	weights := make(map[string]uint, len(w.contexts))
+	for index, executable := range w.contexts {
+		weights[executable.script.name] = w.weights[index]
+	}
+	return weights
+}
+
+// SetWeights changes the weights of the named scripts, which applies to the
+// next step picked. Scripts that share a name all get the new weight. The
+// weights are left unchanged if any name is unknown, or if no script would
+// be left to pick.
+func (w *Worker) SetWeights(weights map[string]uint) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	change, err := w.weightChangeLocked(weights)
+	if err != nil {
+		return err
+	}
+	change()
+	return nil
+}
+
+// weightChangeLocked checks a change of the weights of the named scripts,
+// and returns a function that makes it, so that a change can be checked on
+// several workers before it is made on any of them.
+func (w *Worker) weightChangeLocked(weights map[string]uint) (func(), error) {
+	updated := append([]uint(nil), w.weights...)
+	for name, weight := range weights {
+		var found bool
+		for index, executable := range w.contexts {
+			if executable.script.name == name {
+				updated[index] = weight
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown script: %s", name)
+		}
+	}
+
+	chooser, err := w.chooserLocked(updated)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		w.weights = updated
+		w.chooser.Store(chooser)
+	}, nil
+}
+
+// StepScript advances the script at the given index by a single step, or a
+// whole session, that was scheduled to start at the given time, regardless of
+// weights. It returns false if the script has used up its budget.
+func (w *Worker) StepScript(ctx context.Context, index int, scheduled time.Time) bool {
+	if !w.take(index) {
+		return false
+	}
+
+	w.run(ctx, w.dispatch(index), scheduled)
+	return true
+}
+
+// iteration is a single step, or a whole session, of a script that a worker
+// dispatched.
+type iteration struct {
+	index int
+
+	// rng draws the random choices of the iteration.
+	rng *rand.Rand
+
+	// stepNum and bindings are the step that the iteration advances a script
+	// that is not a session to, and the bindings of its pass over the script.
+	stepNum  int
+	bindings *bindings
+}
+
+// dispatch starts the next iteration of the script at the given index. It
+// must be called by the goroutine that dispatches the iterations of the
+// worker, so that they are numbered, and reserve their steps, in the order
+// they were dispatched rather than in the order they happen to run.
+func (w *Worker) dispatch(index int) *iteration {
+	n := int(w.iterations.Add(1) - 1)
+	it := &iteration{index: index, rng: NewRand(DeriveSeed(w.seed, "iteration", n))}
+	if executable := w.contexts[index]; !executable.script.session {
+		it.stepNum, it.bindings = executable.reserve(it.rng)
+	}
+	return it
+}
+
+// take reserves the steps of the script at the given index that a single pick
+// runs, returning false if its budget is used up.
+func (w *Worker) take(index int) bool {
+	if w.budget == nil {
+		return true
 	}
 
-	log.Info().Int("worker", options.Index).Msg("starting worker")
+	steps := 1
+	if script := w.contexts[index].script; script.session {
+		steps = len(script.steps)
+	}
+	return w.budget.take(index, steps)
+}
 
-	ticker := time.NewTicker(1 * time.Second)
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+func (w *Worker) run(ctx context.Context, it *iteration, scheduled time.Time) {
+	executable := w.contexts[it.index]
+	if executable.script.session {
+		executable.RunSession(ctx, w.index, w.stepTimeout, scheduled, it.rng)
+		return
+	}
+	executable.StepForward(ctx, w.index, w.stepTimeout, scheduled, it)
+}
+
+// Step picks a script by weight and advances it by a single step, or a whole
+// session, that was scheduled to start at the given time. It returns false if
+// every script has used up its budget.
+func (w *Worker) Step(ctx context.Context, scheduled time.Time) bool {
+	index, ok := w.pick()
+	if !ok {
+		return false
+	}
+
+	w.run(ctx, w.dispatch(index), scheduled)
+	return true
+}
+
+// pick chooses a script by weight and reserves the steps it runs, returning
+// false if every script has used up its budget.
+func (w *Worker) pick() (int, bool) {
 	for {
-		select {
-		case <-sigs:
-			log.Info().Int("worker", options.Index).Msg("stopping worker")
-			return
-		case <-ticker.C:
-			chosen := chooser.Pick().(*ExecutableContext)
-			go chosen.StepForward(options.Index, options.StepTimeout)
+		chooser := w.chooser.Load()
+		if chooser == nil {
+			return 0, false
+		}
+
+		index := chooser.PickSource(w.rng).(int)
+		if w.take(index) {
+			return index, true
+		}
+
+		// The chosen script is done, so stop choosing it.
+		if err := w.updateChooser(); err != nil {
+			log.Error().Err(err).Int("worker", w.index).Msg("unable to update chooser")
+			return 0, false
 		}
 	}
 }
@@ -0,0 +1,228 @@
+package thumperrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// chainedSteps returns steps that each check they were given the token of the
+// step before them and return a token of their own, which fail at the given
+// step.
+func chainedSteps(count, failAt int, executed *atomic.Int64) []executableStep {
+	steps := make([]executableStep, 0, count)
+	for i := 0; i < count; i++ {
+		steps = append(steps, executableStep{
+			op: fmt.Sprintf("step%d", i),
+			body: func(_ context.Context, _ *authzed.Client, zt *v1.ZedToken, _ *bindings) (*v1.ZedToken, error) {
+				executed.Add(1)
+
+				expected := ""
+				if i > 0 {
+					expected = fmt.Sprintf("token%d", i-1)
+				}
+				if zt.GetToken() != expected {
+					return nil, fmt.Errorf("step %d got token %q", i, zt.GetToken())
+				}
+				if i == failAt {
+					return nil, errors.New("failed")
+				}
+				return &v1.ZedToken{Token: fmt.Sprintf("token%d", i)}, nil
+			},
+		})
+	}
+	return steps
+}
+
+func TestWorkerSession(t *testing.T) {
+	tests := []struct {
+		name             string
+		failAt           int
+		expectedExecuted int64
+		expectedErrors   uint64
+	}{
+		{"every step runs with the token of the previous one", -1, 3 * 20, 0},
+		{"a failed step ends the session", 1, 2 * 20, 20},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var executed atomic.Int64
+			script := &ExecutableScript{name: "session", weight: 1, session: true, steps: chainedSteps(3, tt.failAt, &executed)}
+
+			results := NewResults()
+			worker, err := NewWorker(WorkerOptions{
+				Clients:     NewClientPool(&authzed.Client{}),
+				Scripts:     []*ExecutableScript{script},
+				StepTimeout: time.Second,
+				Results:     results,
+			})
+			require.NoError(t, err)
+
+			// Sessions of the same script may overlap without sharing tokens.
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					assert.True(t, worker.Step(context.Background(), time.Now()))
+				}()
+			}
+			wg.Wait()
+
+			require.Equal(t, tt.expectedExecuted, executed.Load())
+			summaries := results.Summary()
+			require.Equal(t, tt.expectedErrors, summaries[len(summaries)-1].Errors)
+		})
+	}
+}
+
+func TestWorkerSessionBudget(t *testing.T) {
+	var executed atomic.Int64
+	scripts := []*ExecutableScript{{name: "session", weight: 1, session: true, steps: chainedSteps(3, -1, &executed)}}
+
+	worker, err := NewWorker(WorkerOptions{
+		Clients:     NewClientPool(&authzed.Client{}),
+		Scripts:     scripts,
+		StepTimeout: time.Second,
+		Budget:      NewIterationBudget(scripts, 2),
+	})
+	require.NoError(t, err)
+
+	require.True(t, worker.Step(context.Background(), time.Now()))
+	require.True(t, worker.Step(context.Background(), time.Now()))
+	require.False(t, worker.Step(context.Background(), time.Now()))
+	require.Equal(t, int64(6), executed.Load())
+}
+
+func TestWorkerSessionSleep(t *testing.T) {
+	sleep, err := prepareSleep(config.ScriptStep{Op: "Sleep", Duration: 50 * time.Millisecond})
+	require.NoError(t, err)
+
+	var executed atomic.Int64
+	chained := chainedSteps(2, -1, &executed)
+	script := &ExecutableScript{
+		name:    "session",
+		weight:  1,
+		session: true,
+		steps:   []executableStep{chained[0], {op: "Sleep", sleep: sleep}, chained[1]},
+	}
+
+	results := NewResults()
+	worker, err := NewWorker(WorkerOptions{
+		Clients:     NewClientPool(&authzed.Client{}),
+		Scripts:     []*ExecutableScript{script},
+		StepTimeout: time.Second,
+		Results:     results,
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.True(t, worker.Step(context.Background(), start))
+	require.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	require.Equal(t, int64(2), executed.Load())
+
+	// The sleep is neither recorded nor counted towards the response time of
+	// the step after it.
+	summaries := results.Summary()
+	require.Len(t, summaries, 3)
+	require.Equal(t, "step1", summaries[1].Op)
+	require.Less(t, summaries[1].Response.Max, 50*time.Millisecond)
+	require.Zero(t, summaries[2].Errors)
+}
+
+func TestPrepareSleep(t *testing.T) {
+	tests := []struct {
+		distribution string
+		duration     time.Duration
+		expectedErr  string
+	}{
+		{"", time.Second, ""},
+		{"fixed", time.Second, ""},
+		{"uniform", time.Second, ""},
+		{"exponential", time.Second, ""},
+		{"normal", time.Second, "unknown distribution: normal"},
+		{"fixed", 0, "duration must be positive, got 0s"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.distribution, func(t *testing.T) {
+			sleep, err := prepareSleep(config.ScriptStep{Op: "Sleep", Duration: tt.duration, Distribution: tt.distribution})
+			if tt.expectedErr != "" {
+				require.EqualError(t, err, tt.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			rng := NewRand(1)
+			for i := 0; i < 100; i++ {
+				drawn := sleep(rng)
+				require.GreaterOrEqual(t, drawn, time.Duration(0))
+				if tt.distribution == "" || tt.distribution == "fixed" {
+					require.Equal(t, tt.duration, drawn)
+				}
+				if tt.distribution == "uniform" {
+					require.Less(t, drawn, 2*tt.duration)
+				}
+			}
+		})
+	}
+}
+
+func TestExpectError(t *testing.T) {
+	client := startFakeServer(t, &fakePermissions{checked: make(chan *v1.CheckPermissionRequest, 2)})
+	expand := config.ScriptStep{Op: "ExpandPermissionTree", Resource: "document:readme", Permission: "view"}
+	check := config.ScriptStep{Op: "CheckPermission", Resource: "document:readme", Permission: "view", Subject: "user:tom"}
+	noPermission := check
+	noPermission.ExpectNoPermission = true
+
+	tests := []struct {
+		name        string
+		step        config.ScriptStep
+		expected    *config.ExpectedError
+		expectedErr string
+	}{
+		{"expected code", expand, &config.ExpectedError{Code: "UNIMPLEMENTED"}, ""},
+		{"expected message", expand, &config.ExpectedError{MessageContains: "ExpandPermissionTree not implemented"}, ""},
+		{"wrong code", expand, &config.ExpectedError{Code: "ALREADY_EXISTS"}, "ExpandPermissionTree failed with Unimplemented, but was expected to fail with AlreadyExists"},
+		{"wrong message", expand, &config.ExpectedError{Code: "UNIMPLEMENTED", MessageContains: "permission denied"}, `ExpandPermissionTree failed without "permission denied" in its error`},
+		{"unexpected success", check, &config.ExpectedError{Code: "PERMISSION_DENIED"}, "CheckPermission succeeded, but was expected to fail"},
+		{"failed check of the result", noPermission, &config.ExpectedError{MessageContains: "permissionship"}, "CheckPermission failed without an error from the server: CheckPermission returned wrong permissionship"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.step.ExpectError = tt.expected
+			step, err := prepareStep(tt.step)
+			require.NoError(t, err)
+
+			token := &v1.ZedToken{Token: "given"}
+			zt, err := step.body(context.Background(), client, token, newBindings(NewRand(1)))
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+				require.Equal(t, token, zt)
+			} else {
+				require.ErrorContains(t, err, tt.expectedErr)
+			}
+		})
+	}
+
+	_, err := prepareStep(config.ScriptStep{Op: "ExpandPermissionTree", Resource: "document:readme", Permission: "view", ExpectError: &config.ExpectedError{Code: "MISSING"}})
+	require.EqualError(t, err, "error preparing expectError: unknown error code: MISSING")
+
+	_, err = prepareStep(config.ScriptStep{Op: "ExpandPermissionTree", Resource: "document:readme", Permission: "view", ExpectError: &config.ExpectedError{}})
+	require.EqualError(t, err, "error preparing expectError: either code or messageContains is required")
+
+	_, err = prepareStep(config.ScriptStep{Op: "Sleep", Duration: time.Second, ExpectError: &config.ExpectedError{}})
+	require.EqualError(t, err, "Sleep steps cannot expect errors")
+}
@@ -0,0 +1,185 @@
+package thumperrunner
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+)
+
+// treeExpectations are the assertions on the tree returned by an
+// ExpandPermissionTree step.
+type treeExpectations struct {
+	// includes and excludes are subjects that must, or must not, be found
+	// in the leaves of the tree. They may contain placeholders.
+	includes []string
+	excludes []string
+
+	maxDepth uint
+
+	// golden is the tree the step must return, as rendered by renderTree,
+	// read from goldenFile.
+	golden     string
+	goldenFile string
+
+	// dump adds the rendered tree to the error if any assertion fails.
+	dump bool
+}
+
+// prepareTreeExpectations returns the assertions on the tree of a step, or nil
+// if it has none.
+func prepareTreeExpectations(expected *config.TreeExpectations) (*treeExpectations, error) {
+	if expected == nil {
+		return nil, nil
+	}
+
+	prepared := &treeExpectations{
+		includes: expected.Includes,
+		excludes: expected.Excludes,
+		maxDepth: expected.MaxDepth,
+		dump:     expected.Dump,
+	}
+
+	if expected.Golden != "" {
+		// Like script files, golden files are also looked for in the
+		// kodata directory.
+		path, err := config.FindFile(expected.Golden)
+		if err != nil {
+			return nil, fmt.Errorf("error reading golden tree: %w", err)
+		}
+		prepared.goldenFile = path
+
+		golden, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading golden tree: %w", err)
+		}
+		prepared.golden = strings.TrimRight(string(golden), "\n")
+	}
+
+	return prepared, nil
+}
+
+// verify checks the tree against the assertions, returning an error for the
+// first one that fails.
+func (e *treeExpectations) verify(b *bindings, tree *v1.PermissionRelationshipTree) error {
+	err := e.check(b, tree)
+	if err != nil && e.dump {
+		return fmt.Errorf("%w\nexpanded tree:\n%s", err, renderTree(tree))
+	}
+	return err
+}
+
+func (e *treeExpectations) check(b *bindings, tree *v1.PermissionRelationshipTree) error {
+	leaves := make(map[string]bool)
+	collectLeafSubjects(tree, leaves)
+
+	for _, subject := range e.includes {
+		expanded, err := b.expand(subject)
+		if err != nil {
+			return err
+		}
+		if !leaves[expanded] {
+			return fmt.Errorf("leaf subjects do not include %s", expanded)
+		}
+	}
+	for _, subject := range e.excludes {
+		expanded, err := b.expand(subject)
+		if err != nil {
+			return err
+		}
+		if leaves[expanded] {
+			return fmt.Errorf("leaf subjects include %s", expanded)
+		}
+	}
+
+	if e.maxDepth > 0 {
+		if depth := treeDepth(tree); depth > e.maxDepth {
+			return fmt.Errorf("tree depth %d exceeds maxDepth %d", depth, e.maxDepth)
+		}
+	}
+
+	if e.goldenFile != "" {
+		rendered := renderTree(tree)
+		if rendered != e.golden {
+			return fmt.Errorf("tree differs from %s at %s", e.goldenFile, firstDifference(e.golden, rendered))
+		}
+	}
+
+	return nil
+}
+
+// firstDifference describes the first line in which the rendered tree differs
+// from the expected one.
+func firstDifference(expected, rendered string) string {
+	expectedLines, renderedLines := strings.Split(expected, "\n"), strings.Split(rendered, "\n")
+	for i := 0; ; i++ {
+		switch {
+		case i >= len(expectedLines):
+			return fmt.Sprintf("line %d: expected the end of the tree, got %q", i+1, renderedLines[i])
+		case i >= len(renderedLines):
+			return fmt.Sprintf("line %d: expected %q, got the end of the tree", i+1, expectedLines[i])
+		case expectedLines[i] != renderedLines[i]:
+			return fmt.Sprintf("line %d: expected %q, got %q", i+1, expectedLines[i], renderedLines[i])
+		}
+	}
+}
+
+// collectLeafSubjects adds the subjects found in the leaves of the tree to the
+// given set, as described by describeSubject.
+func collectLeafSubjects(tree *v1.PermissionRelationshipTree, subjects map[string]bool) {
+	if leaf := tree.GetLeaf(); leaf != nil {
+		for _, subject := range leaf.Subjects {
+			subjects[describeSubject(subject)] = true
+		}
+	}
+	for _, child := range tree.GetIntermediate().GetChildren() {
+		collectLeafSubjects(child, subjects)
+	}
+}
+
+// treeDepth returns the number of levels of the tree, counting a single leaf
+// as one.
+func treeDepth(tree *v1.PermissionRelationshipTree) uint {
+	var deepest uint
+	for _, child := range tree.GetIntermediate().GetChildren() {
+		deepest = max(deepest, treeDepth(child))
+	}
+	return deepest + 1
+}
+
+// renderTree renders the tree with a line for every node, indented by its
+// depth. Nodes that combine their children are followed by how they combine
+// them, and leaves are followed by their subjects, in sorted order.
+func renderTree(tree *v1.PermissionRelationshipTree) string {
+	var rendered strings.Builder
+	renderNode(&rendered, tree, "")
+	return strings.TrimRight(rendered.String(), "\n")
+}
+
+func renderNode(rendered *strings.Builder, node *v1.PermissionRelationshipTree, indent string) {
+	object := node.GetExpandedObject()
+	name := fmt.Sprintf("%s:%s#%s", object.GetObjectType(), object.GetObjectId(), node.GetExpandedRelation())
+
+	if intermediate := node.GetIntermediate(); intermediate != nil {
+		operation := strings.ToLower(strings.TrimPrefix(intermediate.Operation.String(), "OPERATION_"))
+		fmt.Fprintf(rendered, "%s%s %s\n", indent, name, operation)
+		for _, child := range intermediate.Children {
+			renderNode(rendered, child, indent+"  ")
+		}
+		return
+	}
+
+	fmt.Fprintf(rendered, "%s%s\n", indent, name)
+	subjects := make([]string, 0, len(node.GetLeaf().GetSubjects()))
+	for _, subject := range node.GetLeaf().GetSubjects() {
+		subjects = append(subjects, describeSubject(subject))
+	}
+	slices.Sort(subjects)
+	for _, subject := range subjects {
+		fmt.Fprintf(rendered, "%s  %s\n", indent, subject)
+	}
+}
@@ -0,0 +1,96 @@
+package thumperrunner
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// readmeTree is the tree of document:readme#view, which its viewers can see
+// unless they are banned.
+func readmeTree() *v1.PermissionRelationshipTree {
+	leaf := func(relation string, subjects ...*v1.SubjectReference) *v1.PermissionRelationshipTree {
+		return &v1.PermissionRelationshipTree{
+			ExpandedObject:   &v1.ObjectReference{ObjectType: "document", ObjectId: "readme"},
+			ExpandedRelation: relation,
+			TreeType:         &v1.PermissionRelationshipTree_Leaf{Leaf: &v1.DirectSubjectSet{Subjects: subjects}},
+		}
+	}
+	user := func(id string) *v1.SubjectReference {
+		return &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: id}}
+	}
+
+	return &v1.PermissionRelationshipTree{
+		ExpandedObject:   &v1.ObjectReference{ObjectType: "document", ObjectId: "readme"},
+		ExpandedRelation: "view",
+		TreeType: &v1.PermissionRelationshipTree_Intermediate{Intermediate: &v1.AlgebraicSubjectSet{
+			Operation: v1.AlgebraicSubjectSet_OPERATION_EXCLUSION,
+			Children: []*v1.PermissionRelationshipTree{
+				leaf("viewer", user("tom"), user("fred")),
+				leaf("banned", user("stacy")),
+			},
+		}},
+	}
+}
+
+const renderedReadmeTree = `document:readme#view exclusion
+  document:readme#viewer
+    user:fred
+    user:tom
+  document:readme#banned
+    user:stacy`
+
+func TestRenderTree(t *testing.T) {
+	require.Equal(t, renderedReadmeTree, renderTree(readmeTree()))
+	require.Equal(t, uint(2), treeDepth(readmeTree()))
+}
+
+func TestExpandExpectTree(t *testing.T) {
+	client := startFakeServer(t, &fakePermissions{tree: readmeTree()})
+
+	dir := t.TempDir()
+	golden := filepath.Join(dir, "readme.tree")
+	require.NoError(t, os.WriteFile(golden, []byte(renderedReadmeTree+"\n"), 0o600))
+	outdated := filepath.Join(dir, "outdated.tree")
+	require.NoError(t, os.WriteFile(outdated, []byte("document:readme#view union\n"), 0o600))
+	t.Setenv("KO_DATA_PATH", dir)
+
+	tests := []struct {
+		name        string
+		expected    config.TreeExpectations
+		expectedErr string
+	}{
+		{"includes", config.TreeExpectations{Includes: []string{"user:tom", "user:stacy"}}, ""},
+		{"excludes", config.TreeExpectations{Excludes: []string{"user:jane"}}, ""},
+		{"depth", config.TreeExpectations{MaxDepth: 2}, ""},
+		{"golden", config.TreeExpectations{Golden: golden}, ""},
+		{"relative golden in kodata", config.TreeExpectations{Golden: "readme.tree"}, ""},
+		{"missing leaf", config.TreeExpectations{Includes: []string{"user:jane"}}, "leaf subjects do not include user:jane"},
+		{"unwanted leaf", config.TreeExpectations{Excludes: []string{"user:fred"}}, "leaf subjects include user:fred"},
+		{"too deep", config.TreeExpectations{MaxDepth: 1}, "tree depth 2 exceeds maxDepth 1"},
+		{"outdated golden", config.TreeExpectations{Golden: outdated}, "tree differs from " + outdated + ` at line 1: expected "document:readme#view union", got "document:readme#view exclusion"`},
+		{"dump", config.TreeExpectations{MaxDepth: 1, Dump: true}, "tree depth 2 exceeds maxDepth 1\nexpanded tree:\n" + renderedReadmeTree},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := prepareStep(config.ScriptStep{Op: "ExpandPermissionTree", Resource: "document:readme", Permission: "view", ExpectTree: &tt.expected})
+			require.NoError(t, err)
+
+			_, err = step.body(context.Background(), client, nil, newBindings(NewRand(1)))
+			if tt.expectedErr == "" {
+				require.NoError(t, err)
+			} else {
+				require.EqualError(t, err, "ExpandPermissionTree returned an unexpected tree for document:readme#view: "+tt.expectedErr)
+			}
+		})
+	}
+
+	_, err := prepareStep(config.ScriptStep{Op: "ExpandPermissionTree", Resource: "document:readme", Permission: "view", ExpectTree: &config.TreeExpectations{Golden: filepath.Join(dir, "missing.tree")}})
+	require.ErrorContains(t, err, "error preparing ExpandPermissionTree expectTree: error reading golden tree")
+}
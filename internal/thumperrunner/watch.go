@@ -0,0 +1,246 @@
+package thumperrunner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	watchEventsCounter = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "thumper",
+		Name:      "watch_events_total",
+		Help:      "Relationship updates received from the Watch API.",
+	}, []string{"operation"})
+
+	watchReconnectsCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "thumper",
+		Name:      "watch_reconnects_total",
+		Help:      "Times the Watch API stream ended and was opened again.",
+	})
+
+	watchLagHistogram = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "thumper",
+		Name:      "watch_lag_seconds",
+		Help:      "Time from a WriteRelationships step returning until the Watch API delivered the relationship it wrote.",
+		Buckets:   LatencyBuckets,
+	})
+
+	watchUnmatchedCounter = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "thumper",
+		Name:      "watch_unmatched_writes_total",
+		Help:      "Relationships written by the run that the Watch API did not deliver within the maximum lag.",
+	})
+)
+
+// DefaultWatchMaxLag is how long a written relationship is waited for before
+// it is counted as unmatched, when no other maximum is given.
+const DefaultWatchMaxLag = time.Minute
+
+// WatcherOptions represent the configuration for a watcher.
+type WatcherOptions struct {
+	// Client is the connection the watcher follows the Watch API over, which
+	// is best kept apart from the ones the workers use.
+	Client *authzed.Client
+
+	// ObjectTypes are the types of the resources whose relationships are
+	// watched.
+	ObjectTypes []string
+
+	// MaxLag is how long a written relationship is waited for before it is
+	// counted as unmatched.
+	MaxLag time.Duration
+
+	// RetryDelay is how long the watcher waits before opening the stream
+	// again after it ended.
+	RetryDelay time.Duration
+}
+
+// Watcher follows the Watch API for changes to the relationships of some
+// object types, counting the changes it receives, and measures how long the
+// relationships written by the run take to arrive.
+type Watcher struct {
+	client      *authzed.Client
+	objectTypes []string
+	watched     map[string]bool
+	maxLag      time.Duration
+	retryDelay  time.Duration
+
+	// cursor is the revision the stream has delivered all changes through,
+	// where it is opened again after it ended.
+	cursor *v1.ZedToken
+
+	// mu guards the relationships written by the run that have not arrived
+	// yet, by when their write returned, and those that arrived before the
+	// write that made them returned, by when they arrived.
+	mu         sync.Mutex
+	pending    map[string]time.Time
+	early      map[string]time.Time
+	lastPruned time.Time
+}
+
+// NewWatcher creates a watcher of the given object types.
+func NewWatcher(options WatcherOptions) (*Watcher, error) {
+	if len(options.ObjectTypes) == 0 {
+		return nil, errors.New("a watcher needs at least one object type")
+	}
+	if options.MaxLag <= 0 {
+		options.MaxLag = DefaultWatchMaxLag
+	}
+	if options.RetryDelay <= 0 {
+		options.RetryDelay = time.Second
+	}
+
+	watched := make(map[string]bool, len(options.ObjectTypes))
+	for _, objectType := range options.ObjectTypes {
+		watched[objectType] = true
+	}
+
+	return &Watcher{
+		client:      options.Client,
+		objectTypes: options.ObjectTypes,
+		watched:     watched,
+		maxLag:      options.MaxLag,
+		retryDelay:  options.RetryDelay,
+		pending:     make(map[string]time.Time),
+		early:       make(map[string]time.Time),
+		lastPruned:  time.Now(),
+	}, nil
+}
+
+// Run follows the Watch API until the context is cancelled, opening the
+// stream again from where it left off whenever it ends.
+func (w *Watcher) Run(ctx context.Context) {
+	log.Info().Strs("object-types", w.objectTypes).Msg("watching relationships")
+
+	for {
+		err := w.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+
+		watchReconnectsCounter.Inc()
+		log.Warn().Err(err).Dur("retry-delay", w.retryDelay).Msg("watch stream ended, reconnecting")
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.retryDelay):
+		}
+	}
+}
+
+// follow receives changes from a single Watch API stream until it ends.
+func (w *Watcher) follow(ctx context.Context) error {
+	stream, err := w.client.Watch(ctx, &v1.WatchRequest{
+		OptionalObjectTypes: w.objectTypes,
+		OptionalStartCursor: w.cursor,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+
+		w.received(resp.Updates, time.Now())
+		if resp.ChangesThrough != nil {
+			w.cursor = resp.ChangesThrough
+		}
+	}
+}
+
+// written records the relationships of watched types written by a
+// WriteRelationships step whose call returned at the given time.
+func (w *Watcher) written(updates []*v1.RelationshipUpdate, at time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, update := range updates {
+		if !w.watched[update.Relationship.GetResource().GetObjectType()] {
+			continue
+		}
+
+		key := watchKey(update)
+		if _, ok := w.early[key]; ok {
+			watchLagHistogram.Observe(0)
+			delete(w.early, key)
+			continue
+		}
+		w.pending[key] = at
+	}
+
+	w.maybePruneLocked(at)
+}
+
+// received counts the updates delivered by the Watch API at the given time,
+// and measures the lag of those the run wrote.
+func (w *Watcher) received(updates []*v1.RelationshipUpdate, at time.Time) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, update := range updates {
+		operation := strings.ToLower(strings.TrimPrefix(update.Operation.String(), "OPERATION_"))
+		watchEventsCounter.WithLabelValues(operation).Inc()
+
+		key := watchKey(update)
+		if writtenAt, ok := w.pending[key]; ok {
+			watchLagHistogram.Observe(at.Sub(writtenAt).Seconds())
+			delete(w.pending, key)
+			continue
+		}
+		w.early[key] = at
+	}
+
+	w.maybePruneLocked(at)
+}
+
+// maybePruneLocked drops the relationships that were written but never
+// arrived, for example because a TOUCH changed nothing, and those that arrived
+// but were never written by the run, once they are older than the maximum
+// lag. It only looks at them every so often, so that they do not pile up.
+func (w *Watcher) maybePruneLocked(now time.Time) {
+	if now.Sub(w.lastPruned) < w.maxLag {
+		return
+	}
+
+	for key, writtenAt := range w.pending {
+		if now.Sub(writtenAt) > w.maxLag {
+			watchUnmatchedCounter.Inc()
+			delete(w.pending, key)
+		}
+	}
+	for key, arrivedAt := range w.early {
+		if now.Sub(arrivedAt) > w.maxLag {
+			delete(w.early, key)
+		}
+	}
+	w.lastPruned = now
+}
+
+// watchKey identifies the change to a relationship made by an update, which is
+// the same for the update that was written and the one the Watch API
+// delivers. Creates and touches are not told apart, since the Watch API may
+// deliver a create as a touch.
+func watchKey(update *v1.RelationshipUpdate) string {
+	change := "write"
+	if update.Operation == v1.RelationshipUpdate_OPERATION_DELETE {
+		change = "delete"
+	}
+
+	relationship := update.Relationship
+	resource := relationship.GetResource()
+	return fmt.Sprintf("%s %s:%s#%s@%s", change, resource.GetObjectType(), resource.GetObjectId(), relationship.GetRelation(), describeSubject(relationship.GetSubject()))
+}
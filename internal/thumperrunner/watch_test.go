@@ -0,0 +1,154 @@
+package thumperrunner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/authzed/internal/thumper/internal/config"
+
+	v1 "github.com/authzed/authzed-go/proto/authzed/api/v1"
+	"github.com/authzed/authzed-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func viewerUpdate(operation v1.RelationshipUpdate_Operation, resourceType, resourceID string) *v1.RelationshipUpdate {
+	return &v1.RelationshipUpdate{
+		Operation: operation,
+		Relationship: &v1.Relationship{
+			Resource: &v1.ObjectReference{ObjectType: resourceType, ObjectId: resourceID},
+			Relation: "viewer",
+			Subject:  &v1.SubjectReference{Object: &v1.ObjectReference{ObjectType: "user", ObjectId: "tom"}},
+		},
+	}
+}
+
+func TestWatcherMatchesWrites(t *testing.T) {
+	watcher, err := NewWatcher(WatcherOptions{Client: &authzed.Client{}, ObjectTypes: []string{"document"}, MaxLag: time.Minute})
+	require.NoError(t, err)
+
+	start := watcher.lastPruned
+	touch := viewerUpdate(v1.RelationshipUpdate_OPERATION_TOUCH, "document", "readme")
+	create := viewerUpdate(v1.RelationshipUpdate_OPERATION_CREATE, "document", "readme")
+	deleted := viewerUpdate(v1.RelationshipUpdate_OPERATION_DELETE, "document", "readme")
+	folder := viewerUpdate(v1.RelationshipUpdate_OPERATION_TOUCH, "folder", "home")
+
+	// A create arrives as the touch that wrote it, and relationships of
+	// types that are not watched are not waited for.
+	watcher.written([]*v1.RelationshipUpdate{create, folder}, start)
+	require.Len(t, watcher.pending, 1)
+	watcher.received([]*v1.RelationshipUpdate{touch}, start.Add(50*time.Millisecond))
+	require.Empty(t, watcher.pending)
+	require.Empty(t, watcher.early)
+
+	// A change may arrive before the write that made it returns.
+	watcher.received([]*v1.RelationshipUpdate{deleted}, start.Add(time.Second))
+	require.Len(t, watcher.early, 1)
+	watcher.written([]*v1.RelationshipUpdate{deleted}, start.Add(time.Second))
+	require.Empty(t, watcher.pending)
+	require.Empty(t, watcher.early)
+
+	// Writes that never arrive are dropped once they are older than the
+	// maximum lag.
+	unmatched := testutil.ToFloat64(watchUnmatchedCounter)
+	watcher.written([]*v1.RelationshipUpdate{touch}, start.Add(2*time.Second))
+	watcher.received([]*v1.RelationshipUpdate{folder}, start.Add(3*time.Second))
+	require.Len(t, watcher.pending, 1)
+	require.Len(t, watcher.early, 1)
+	watcher.written(nil, start.Add(2*time.Minute))
+	require.Empty(t, watcher.pending)
+	require.Empty(t, watcher.early)
+	require.Equal(t, unmatched+1, testutil.ToFloat64(watchUnmatchedCounter))
+
+	_, err = NewWatcher(WatcherOptions{Client: &authzed.Client{}})
+	require.EqualError(t, err, "a watcher needs at least one object type")
+}
+
+func TestWorkerReportsWrites(t *testing.T) {
+	alreadyExists := status.Error(codes.AlreadyExists, "relationship already existed")
+
+	tests := []struct {
+		name            string
+		expectError     *config.ExpectedError
+		writeErr        error
+		expectedPending int
+	}{
+		{"write", nil, nil, 1},
+		{"failed write", nil, alreadyExists, 0},
+		{"expected failure", &config.ExpectedError{Code: "ALREADY_EXISTS"}, alreadyExists, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step, err := prepareStep(config.ScriptStep{
+				Op:          "WriteRelationships",
+				Updates:     []config.Update{{Op: "CREATE", Resource: "document:${rand:doc}", Relation: "viewer", Subject: "user:tom"}},
+				ExpectError: tt.expectError,
+			})
+			require.NoError(t, err)
+
+			watcher, err := NewWatcher(WatcherOptions{Client: &authzed.Client{}, ObjectTypes: []string{"document"}})
+			require.NoError(t, err)
+
+			worker, err := NewWorker(WorkerOptions{
+				Clients:     NewClientPool(startFakeServer(t, &fakePermissions{writeErr: tt.writeErr})),
+				Scripts:     []*ExecutableScript{{name: "writes", weight: 1, steps: []executableStep{step}}},
+				StepTimeout: time.Second,
+				Watcher:     watcher,
+			})
+			require.NoError(t, err)
+
+			require.True(t, worker.Step(context.Background(), time.Now()))
+			require.Len(t, watcher.pending, tt.expectedPending)
+			for key := range watcher.pending {
+				require.Regexp(t, `^write document:\S+#viewer@user:tom$`, key)
+			}
+		})
+	}
+}
+
+func TestWatcherReconnects(t *testing.T) {
+	watch := &fakeWatch{
+		streams: []fakeWatchStream{{
+			responses: []*v1.WatchResponse{{
+				Updates:        []*v1.RelationshipUpdate{viewerUpdate(v1.RelationshipUpdate_OPERATION_TOUCH, "document", "readme")},
+				ChangesThrough: &v1.ZedToken{Token: "first"},
+			}},
+			err: status.Error(codes.Unavailable, "restarting"),
+		}},
+		requests: make(chan *v1.WatchRequest, 2),
+	}
+	client := startFakeWatchServer(t, watch)
+
+	watcher, err := NewWatcher(WatcherOptions{Client: client, ObjectTypes: []string{"document"}, RetryDelay: time.Millisecond})
+	require.NoError(t, err)
+
+	reconnects := testutil.ToFloat64(watchReconnectsCounter)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		watcher.Run(ctx)
+		close(done)
+	}()
+
+	first := <-watch.requests
+	require.Equal(t, []string{"document"}, first.OptionalObjectTypes)
+	require.Nil(t, first.OptionalStartCursor)
+
+	// The stream is opened again from where the first one ended.
+	second := <-watch.requests
+	require.Equal(t, "first", second.OptionalStartCursor.GetToken())
+	require.Equal(t, reconnects+1, testutil.ToFloat64(watchReconnectsCounter))
+
+	cancel()
+	require.Eventually(t, func() bool {
+		select {
+		case <-done:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+}